@@ -0,0 +1,240 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/utils"
+)
+
+// TOKEN_SWAP_KEY the key of the token in the session Swap(),
+// which is the reply of the authentication handshake.
+const TOKEN_SWAP_KEY = "cliSession.token"
+
+// Authenticator the authentication handshake pull,
+// it is run on each newly dialed session before the session is handed out.
+type Authenticator struct {
+	// Uri the URI of the handshake pull.
+	Uri string
+	// Arg returns the arg of the handshake pull, it is called for each handshake.
+	Arg func() interface{}
+	// NewResult returns the result of the handshake pull, default *string.
+	// The value it points to is stored as the token.
+	NewResult func() interface{}
+	// ExpiredCodes the Rerror codes replied when the token expired,
+	// then the session is re-authenticated and the pull(also AsyncPull) is re-sent on it once.
+	ExpiredCodes []int32
+}
+
+// SetAuthenticator sets the authentication handshake of the newly dialed sessions.
+// Note: If auth is nil, do not authenticate.
+func (c *CliSession) SetAuthenticator(auth *Authenticator) {
+	if auth != nil {
+		a := *auth
+		a.ExpiredCodes = append([]int32(nil), auth.ExpiredCodes...)
+		auth = &a
+	}
+	c.optMu.Lock()
+	c.auth = auth
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getAuthenticator() *Authenticator {
+	c.optMu.RLock()
+	auth := c.auth
+	c.optMu.RUnlock()
+	return auth
+}
+
+// SetOnNewSession sets the hook that is run on each newly dialed session,
+// after the authentication handshake and before the session is handed out.
+// If the hook returns an error, the session is closed and the dialing fails.
+// Note: If fn is nil, remove the hook.
+func (c *CliSession) SetOnNewSession(fn func(sess tp.Session) *tp.Rerror) {
+	c.optMu.Lock()
+	c.onNewSess = fn
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getOnNewSession() func(tp.Session) *tp.Rerror {
+	c.optMu.RLock()
+	fn := c.onNewSess
+	c.optMu.RUnlock()
+	return fn
+}
+
+// Token returns the token of the session that is stored by the authentication handshake.
+func Token(sess tp.Session) (interface{}, bool) {
+	return sess.Swap().Load(TOKEN_SWAP_KEY)
+}
+
+// handshake authenticates the newly dialed session and runs the OnNewSession hook,
+// the session is closed if it fails.
+func (c *CliSession) handshake(sess tp.Session) *tp.Rerror {
+	rerr := c.getAuthenticator().login(sess)
+	if rerr == nil {
+		if fn := c.getOnNewSession(); fn != nil {
+			rerr = fn(sess)
+		}
+	}
+	if rerr != nil {
+		sess.Close()
+		return rerr
+	}
+	return nil
+}
+
+const authSwapKey swapKey = "auth"
+
+// sessionAuth the authentication state of a session.
+type sessionAuth struct {
+	authed time.Time
+	mu     sync.Mutex
+}
+
+func (a *Authenticator) login(sess tp.Session) *tp.Rerror {
+	if a == nil {
+		return nil
+	}
+	var arg interface{}
+	if a.Arg != nil {
+		arg = a.Arg()
+	}
+	var result interface{}
+	if a.NewResult != nil {
+		result = a.NewResult()
+	} else {
+		result = new(string)
+	}
+	rerr := sess.Pull(a.Uri, arg, result).Rerror()
+	if rerr != nil {
+		tp.Warnf("cliSession: authenticate %s error: %v", sess.RemoteAddr(), rerr)
+		return rerr
+	}
+	sess.Swap().Store(TOKEN_SWAP_KEY, reflect.ValueOf(result).Elem().Interface())
+	v, _ := sess.Swap().LoadOrStore(authSwapKey, new(sessionAuth))
+	v.(*sessionAuth).authed = time.Now()
+	return nil
+}
+
+func (a *Authenticator) expired(rerr *tp.Rerror) bool {
+	if a == nil || rerr == nil {
+		return false
+	}
+	for _, code := range a.ExpiredCodes {
+		if rerr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// reauthenticate re-authenticates the session if the rerr means the token expired,
+// it returns true if the pull sent since the start should be re-sent.
+func (c *CliSession) reauthenticate(sess tp.Session, rerr *tp.Rerror, start time.Time) bool {
+	auth := c.getAuthenticator()
+	if !auth.expired(rerr) || !sess.Health() {
+		return false
+	}
+	v, _ := sess.Swap().LoadOrStore(authSwapKey, new(sessionAuth))
+	state := v.(*sessionAuth)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.authed.After(start) {
+		// it has been re-authenticated by another pull.
+		return true
+	}
+	tp.Debugf("cliSession: the token of %s expired, re-authenticate", sess.RemoteAddr())
+	return auth.login(sess) == nil
+}
+
+// authedPullCmd the PullCmd that may be re-sent after the re-authentication,
+// it reports the last pull once done.
+type authedPullCmd struct {
+	first tp.PullCmd
+	last  tp.PullCmd // set before the done is closed
+	done  chan struct{}
+}
+
+var _ tp.PullCmd = (*authedPullCmd)(nil)
+
+func (p *authedPullCmd) cmd() tp.PullCmd {
+	select {
+	case <-p.done:
+		return p.last
+	default:
+		return p.first
+	}
+}
+
+// TracePeer trace back the peer.
+func (p *authedPullCmd) TracePeer() (tp.Peer, bool) {
+	return p.first.TracePeer()
+}
+
+// TraceSession trace back the session.
+func (p *authedPullCmd) TraceSession() (tp.Session, bool) {
+	return p.first.TraceSession()
+}
+
+// Context carries a deadline, a cancelation signal, and other values across API boundaries.
+func (p *authedPullCmd) Context() context.Context {
+	return p.cmd().Context()
+}
+
+// Output returns writed packet.
+func (p *authedPullCmd) Output() *socket.Packet {
+	return p.cmd().Output()
+}
+
+// Result returns the pull result.
+// Notes: Inside, <-Done() is automatically called and blocked, until the pull is completed!
+func (p *authedPullCmd) Result() (interface{}, *tp.Rerror) {
+	<-p.done
+	return p.last.Result()
+}
+
+// Rerror returns the pull error.
+// Notes: Inside, <-Done() is automatically called and blocked, until the pull is completed!
+func (p *authedPullCmd) Rerror() *tp.Rerror {
+	<-p.done
+	return p.last.Rerror()
+}
+
+// Done returns the chan that indicates whether it has been completed.
+func (p *authedPullCmd) Done() <-chan struct{} {
+	return p.done
+}
+
+// InputMeta returns the header metadata of input packet.
+// Notes: Inside, <-Done() is automatically called and blocked, until the pull is completed!
+func (p *authedPullCmd) InputMeta() *utils.Args {
+	<-p.done
+	return p.last.InputMeta()
+}
+
+// CostTime returns the pulled cost time.
+// If PeerConfig.CountTime=false, always returns 0.
+// Notes: Inside, <-Done() is automatically called and blocked, until the pull is completed!
+func (p *authedPullCmd) CostTime() time.Duration {
+	<-p.done
+	return p.last.CostTime()
+}
@@ -0,0 +1,293 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/henrylee2cn/goutil"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// HASH_KEY_META_KEY if the metadata is set, the consistent-hash balancer uses it as the hash key.
+const HASH_KEY_META_KEY = "X-Hash-Key"
+
+// WithHashKey sets the key used by the consistent-hash balancer to select the node.
+func WithHashKey(key string) socket.PacketSetting {
+	return func(packet *socket.Packet) {
+		packet.Meta().Set(HASH_KEY_META_KEY, key)
+	}
+}
+
+type (
+	// Balancer selects a node for each call.
+	Balancer interface {
+		// Name returns the balancer name.
+		Name() string
+		// Select returns one of the nodes, or nil if nodes is empty.
+		Select(nodes []*Node, uri string, setting ...socket.PacketSetting) *Node
+	}
+	// Node one address of the cluster and its session pool.
+	Node struct {
+		addr     string
+		sess     *CliSession
+		inflight int32
+		draining bool
+		mu       sync.Mutex
+	}
+)
+
+// Addr returns the node address.
+func (n *Node) Addr() string {
+	return n.addr
+}
+
+// Session returns the session pool of the node.
+func (n *Node) Session() *CliSession {
+	return n.sess
+}
+
+// Inflight returns the number of the calls in progress.
+func (n *Node) Inflight() int32 {
+	return atomic.LoadInt32(&n.inflight)
+}
+
+// begin starts a call on the node, it returns false if the node is being drained.
+func (n *Node) begin() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.draining {
+		return false
+	}
+	atomic.AddInt32(&n.inflight, 1)
+	return true
+}
+
+func (n *Node) end() {
+	atomic.AddInt32(&n.inflight, -1)
+}
+
+// drain stops the node from starting new calls,
+// and shuts down the session pool gracefully after the calls in progress are finished.
+func (n *Node) drain() {
+	n.mu.Lock()
+	n.draining = true
+	n.mu.Unlock()
+	n.sess.Shutdown(context.Background())
+}
+
+// NewRoundRobinBalancer returns a balancer that selects the nodes in turn.
+func NewRoundRobinBalancer() Balancer {
+	return new(roundRobinBalancer)
+}
+
+type roundRobinBalancer struct {
+	next uint32
+}
+
+func (*roundRobinBalancer) Name() string {
+	return "round-robin"
+}
+
+func (r *roundRobinBalancer) Select(nodes []*Node, _ string, _ ...socket.PacketSetting) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&r.next, 1) - 1
+	return nodes[i%uint32(len(nodes))]
+}
+
+// NewWeightedRandomBalancer returns a balancer that selects the nodes randomly by weight.
+// Note: The addresses that are not in weights have a weight of 1.
+func NewWeightedRandomBalancer(weights map[string]int) Balancer {
+	w := make(map[string]int, len(weights))
+	for addr, weight := range weights {
+		w[addr] = weight
+	}
+	return &weightedRandomBalancer{weights: w}
+}
+
+type weightedRandomBalancer struct {
+	weights map[string]int
+	mu      sync.Mutex
+	rand    *rand.Rand
+}
+
+func (*weightedRandomBalancer) Name() string {
+	return "weighted-random"
+}
+
+func (w *weightedRandomBalancer) weight(addr string) int {
+	weight, ok := w.weights[addr]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+func (w *weightedRandomBalancer) Select(nodes []*Node, _ string, _ ...socket.PacketSetting) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	var total int
+	for _, n := range nodes {
+		total += w.weight(n.addr)
+	}
+	if total == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	if w.rand == nil {
+		w.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	r := w.rand.Intn(total)
+	w.mu.Unlock()
+	for _, n := range nodes {
+		r -= w.weight(n.addr)
+		if r < 0 {
+			return n
+		}
+	}
+	return nodes[len(nodes)-1]
+}
+
+// NewLeastInflightBalancer returns a balancer that selects the node with the fewest calls in progress.
+func NewLeastInflightBalancer() Balancer {
+	return new(leastInflightBalancer)
+}
+
+type leastInflightBalancer struct {
+	next uint32
+}
+
+func (*leastInflightBalancer) Name() string {
+	return "least-inflight"
+}
+
+func (l *leastInflightBalancer) Select(nodes []*Node, _ string, _ ...socket.PacketSetting) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	// start from a rotating offset, so that the idle nodes are used evenly.
+	offset := int(atomic.AddUint32(&l.next, 1) % uint32(len(nodes)))
+	var min *Node
+	for i := range nodes {
+		n := nodes[(offset+i)%len(nodes)]
+		if min == nil || n.Inflight() < min.Inflight() {
+			min = n
+		}
+	}
+	return min
+}
+
+// NewConsistentHashBalancer returns a balancer that selects the node by consistent hashing.
+// The hash key is set by WithHashKey, otherwise the URI is used.
+// The replicas argument is the number of virtual nodes of each address.
+func NewConsistentHashBalancer(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &consistentHashBalancer{replicas: replicas}
+}
+
+type consistentHashBalancer struct {
+	replicas int
+	ring     atomic.Value // *hashRing
+}
+
+// hashRing the immutable ring of the addresses, which is swapped when the addresses change.
+type hashRing struct {
+	key    string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func (*consistentHashBalancer) Name() string {
+	return "consistent-hash"
+}
+
+func (c *consistentHashBalancer) Select(nodes []*Node, uri string, setting ...socket.PacketSetting) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	key := uri
+	if len(setting) > 0 {
+		packet := socket.NewPacket(setting...)
+		if b := packet.Meta().Peek(HASH_KEY_META_KEY); len(b) > 0 {
+			key = goutil.BytesToString(b)
+		}
+	}
+	addr := c.getRing(nodes).lookup(crc32.ChecksumIEEE(goutil.StringToBytes(key)))
+	for _, n := range nodes {
+		if n.addr == addr {
+			return n
+		}
+	}
+	return nodes[0]
+}
+
+// getRing returns the ring of the nodes, it is rebuilt and swapped in if the addresses change.
+func (c *consistentHashBalancer) getRing(nodes []*Node) *hashRing {
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.addr
+	}
+	sort.Strings(addrs)
+	key := strings.Join(addrs, ",")
+	if r, ok := c.ring.Load().(*hashRing); ok && r.key == key {
+		return r
+	}
+	r := newHashRing(addrs, key, c.replicas)
+	c.ring.Store(r)
+	return r
+}
+
+func newHashRing(addrs []string, key string, replicas int) *hashRing {
+	r := &hashRing{
+		key:    key,
+		hashes: make([]uint32, 0, len(addrs)*replicas),
+		owners: make(map[uint32]string, len(addrs)*replicas),
+	}
+	for _, addr := range addrs {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE(goutil.StringToBytes(addr + "#" + strconv.Itoa(i)))
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = addr
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *hashRing) lookup(h uint32) string {
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,299 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// CodeCircuitOpen the Rerror code returned when the circuit breaker is open.
+const CodeCircuitOpen int32 = 1503
+
+// BreakerState the circuit breaker state.
+type BreakerState int32
+
+// circuit breaker states
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// String returns the state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type (
+	// BreakerConfig the circuit breaker config.
+	BreakerConfig struct {
+		// ConsecutiveFailures trips the breaker after so many consecutive failures, 0 means disabled.
+		ConsecutiveFailures int
+		// ErrorRate trips the breaker when the error rate in the window reaches it, 0 means disabled.
+		ErrorRate float64
+		// MinRequests the minimum number of calls in the window before evaluating ErrorRate, default 10.
+		MinRequests int
+		// Window the sliding window of ErrorRate, default 10s, and at least 10ms.
+		Window time.Duration
+		// OpenTimeout the duration of the open state before turning to half-open, default 5s.
+		OpenTimeout time.Duration
+		// HalfOpenProbes the maximum number of concurrent probe calls in the half-open state,
+		// and the number of successful probes required to close the breaker, default 1.
+		HalfOpenProbes int
+		// FailureCodes the Rerror codes counted as failures,
+		// default DefaultRetryableCodes and CodeDeadlineExceeded.
+		FailureCodes []int32
+		// OnStateChange is called asynchronously when the state changes.
+		OnStateChange func(addr string, from, to BreakerState)
+	}
+	// BreakerStats the circuit breaker stats.
+	BreakerStats struct {
+		State               BreakerState
+		Transitions         uint64
+		ConsecutiveFailures int
+		WindowRequests      int
+		WindowFailures      int
+		LastTransition      time.Time
+	}
+)
+
+const (
+	breakerBuckets = 10
+	// the minimum window, so that each bucket is at least 1ms
+	minBreakerWindow = breakerBuckets * time.Millisecond
+)
+
+type (
+	breaker struct {
+		addr   string
+		cfg    BreakerConfig
+		rerr   *tp.Rerror
+		mu     sync.Mutex
+		state  BreakerState
+		stats  BreakerStats
+		bucket [breakerBuckets]breakerBucket
+		// the time to turn to half-open
+		openUntil time.Time
+		// half-open probes
+		probing   int
+		succeeded int
+	}
+	breakerBucket struct {
+		start    time.Time
+		requests int
+		failures int
+	}
+)
+
+// breakerProbe the generation of the half-open state that a probe call is allowed in,
+// which is the number of the state transitions, and 0 means the call is not a probe.
+type breakerProbe uint64
+
+// SetCircuitBreaker sets the circuit breaker of the session pool.
+// Note: If cfg is nil, disable the circuit breaker.
+func (c *CliSession) SetCircuitBreaker(cfg *BreakerConfig) {
+	var b *breaker
+	if cfg != nil {
+		b = newBreaker(c.addr, *cfg)
+	}
+	c.optMu.Lock()
+	c.breaker = b
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getBreaker() *breaker {
+	c.optMu.RLock()
+	b := c.breaker
+	c.optMu.RUnlock()
+	return b
+}
+
+func newBreaker(addr string, cfg BreakerConfig) *breaker {
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 10
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second * 10
+	} else if cfg.Window < minBreakerWindow {
+		cfg.Window = minBreakerWindow
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = time.Second * 5
+	}
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = 1
+	}
+	if len(cfg.FailureCodes) == 0 {
+		cfg.FailureCodes = append(DefaultRetryableCodes[:len(DefaultRetryableCodes):len(DefaultRetryableCodes)], CodeDeadlineExceeded)
+	}
+	cfg.FailureCodes = append([]int32(nil), cfg.FailureCodes...)
+	return &breaker{
+		addr: addr,
+		cfg:  cfg,
+		rerr: tp.NewRerror(CodeCircuitOpen, "Circuit Breaker Open", addr),
+	}
+}
+
+// allow reports whether the call is allowed, probe is not 0 if it is a half-open probe.
+func (b *breaker) allow() (probe breakerProbe, rerr *tp.Rerror) {
+	if b == nil {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if time.Now().Before(b.openUntil) {
+			return 0, b.rerr
+		}
+		b.transitLocked(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing >= b.cfg.HalfOpenProbes {
+			return 0, b.rerr
+		}
+		b.probing++
+		return breakerProbe(b.stats.Transitions), nil
+	}
+	return 0, nil
+}
+
+// done records the result of the allowed call.
+// The probe of the previous half-open state is ignored, so that it does not free a slot of the current one.
+func (b *breaker) done(probe breakerProbe, rerr *tp.Rerror) {
+	if b == nil {
+		return
+	}
+	failed := b.isFailure(rerr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe != 0 {
+		if b.state != BreakerHalfOpen || uint64(probe) != b.stats.Transitions {
+			return
+		}
+		b.probing--
+		if failed {
+			b.transitLocked(BreakerOpen)
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.cfg.HalfOpenProbes {
+			b.transitLocked(BreakerClosed)
+		}
+		return
+	}
+	if b.state != BreakerClosed {
+		return
+	}
+	bucket := b.currentBucketLocked()
+	bucket.requests++
+	if !failed {
+		b.stats.ConsecutiveFailures = 0
+		return
+	}
+	bucket.failures++
+	b.stats.ConsecutiveFailures++
+	if b.cfg.ConsecutiveFailures > 0 && b.stats.ConsecutiveFailures >= b.cfg.ConsecutiveFailures {
+		b.transitLocked(BreakerOpen)
+		return
+	}
+	if b.cfg.ErrorRate > 0 {
+		requests, failures := b.windowLocked()
+		if requests >= b.cfg.MinRequests && float64(failures)/float64(requests) >= b.cfg.ErrorRate {
+			b.transitLocked(BreakerOpen)
+		}
+	}
+}
+
+func (b *breaker) isFailure(rerr *tp.Rerror) bool {
+	if rerr == nil {
+		return false
+	}
+	for _, code := range b.cfg.FailureCodes {
+		if code == rerr.Code {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *breaker) currentBucketLocked() *breakerBucket {
+	width := b.cfg.Window / breakerBuckets
+	now := time.Now()
+	start := now.Truncate(width)
+	bucket := &b.bucket[(now.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+func (b *breaker) windowLocked() (requests, failures int) {
+	since := time.Now().Add(-b.cfg.Window)
+	for _, bucket := range b.bucket {
+		if bucket.start.After(since) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return
+}
+
+func (b *breaker) transitLocked(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.stats.Transitions++
+	b.stats.LastTransition = time.Now()
+	b.probing = 0
+	b.succeeded = 0
+	switch to {
+	case BreakerOpen:
+		b.openUntil = time.Now().Add(b.cfg.OpenTimeout)
+	case BreakerClosed:
+		b.stats.ConsecutiveFailures = 0
+		b.bucket = [breakerBuckets]breakerBucket{}
+	}
+	tp.Infof("cliSession: circuit breaker of %s: %s -> %s", b.addr, from, to)
+	if fn := b.cfg.OnStateChange; fn != nil {
+		tp.Go(func() {
+			fn(b.addr, from, to)
+		})
+	}
+}
+
+func (b *breaker) getStats() *BreakerStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.State = b.state
+	stats.WindowRequests, stats.WindowFailures = b.windowLocked()
+	return &stats
+}
@@ -0,0 +1,293 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// CACHE_CONTROL_META_KEY the cache control metadata of the reply, which overrides the TTL of the URI.
+// e.g. "max-age=60" caches the reply for 60 seconds, "no-store" or "no-cache" does not cache it.
+const CACHE_CONTROL_META_KEY = "X-Cache-Control"
+
+// CacheConfig the configuration of the client-side response cache.
+type CacheConfig struct {
+	// TTLs the time to live of the replies by the URI path, only these URIs are cached.
+	TTLs map[string]time.Duration
+	// MaxEntries the maximum number of the cached replies,
+	// the least recently used ones are evicted, default 1024.
+	MaxEntries int
+}
+
+// CacheStats the response cache stats.
+type CacheStats struct {
+	// Entries the number of the cached replies.
+	Entries int
+	// Hits the number of the pulls that are replied from the cache.
+	Hits uint64
+	// Misses the number of the pulls that are sent.
+	Misses uint64
+	// Coalesced the number of the pulls that share the reply of a concurrent identical pull.
+	Coalesced uint64
+	// Evicted the number of the replies that are evicted by the size limit.
+	Evicted uint64
+}
+
+// SetCache sets the client-side response cache of the pulls.
+// The reply is cached by the URI and the arg encoded by the body codec of the pull, JSON if not set,
+// and the reply is encoded by the body codec too, then decoded into the result on a hit.
+// The concurrent identical pulls share one network round trip.
+// Note: If cfg is nil, do not cache.
+func (c *CliSession) SetCache(cfg *CacheConfig) {
+	var rc *responseCache
+	if cfg != nil {
+		rc = newResponseCache(*cfg)
+	}
+	c.optMu.Lock()
+	c.cache = rc
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getCache() *responseCache {
+	c.optMu.RLock()
+	rc := c.cache
+	c.optMu.RUnlock()
+	return rc
+}
+
+type (
+	responseCache struct {
+		ttls       map[string]time.Duration
+		maxEntries int
+		lru        *list.List
+		entries    map[string]*list.Element
+		flights    map[string]*cacheFlight
+		stats      CacheStats
+		mu         sync.Mutex
+	}
+	cacheEntry struct {
+		key     string
+		reply   cachedReply
+		expires time.Time
+	}
+	cacheFlight struct {
+		reply cachedReply
+		// shared is true if the reply can be shared
+		shared bool
+		rerr   *tp.Rerror
+		done   chan struct{}
+	}
+	// cachedReply the encoded reply and its body codec.
+	cachedReply struct {
+		body      []byte
+		bodyCodec byte
+	}
+)
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 1024
+	}
+	ttls := make(map[string]time.Duration, len(cfg.TTLs))
+	for uri, ttl := range cfg.TTLs {
+		ttls[uri] = ttl
+	}
+	return &responseCache{
+		ttls:       ttls,
+		maxEntries: cfg.MaxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		flights:    make(map[string]*cacheFlight),
+	}
+}
+
+// do replies from the cache, or joins the concurrent identical pull, or calls pull.
+func (rc *responseCache) do(ctx context.Context, uri string, arg interface{}, result interface{}, setting []socket.PacketSetting, pull func() tp.PullCmd) tp.PullCmd {
+	if rc == nil || result == nil {
+		return pull()
+	}
+	ttl, ok := rc.ttls[uriPath(uri)]
+	if !ok {
+		return pull()
+	}
+	key, ok := cacheKey(uri, arg, setting)
+	if !ok {
+		return pull()
+	}
+
+	rc.mu.Lock()
+	if reply, ok := rc.getLocked(key); ok {
+		rc.stats.Hits++
+		rc.mu.Unlock()
+		return replyFromCache(uri, arg, result, reply)
+	}
+	if f, ok := rc.flights[key]; ok {
+		rc.stats.Coalesced++
+		rc.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return tp.NewFakePullCmd(uri, arg, result, toContextRerror(ctx.Err()))
+		}
+		if f.shared {
+			return replyFromCache(uri, arg, result, f.reply)
+		}
+		if f.rerr != nil && f.rerr.Code != CodeCanceled && f.rerr.Code != CodeDeadlineExceeded {
+			return tp.NewFakePullCmd(uri, arg, result, f.rerr)
+		}
+		// the ctx of the leading pull is done, or its reply can not be encoded, pull by self.
+		return pull()
+	}
+	f := &cacheFlight{done: make(chan struct{})}
+	rc.flights[key] = f
+	rc.stats.Misses++
+	rc.mu.Unlock()
+
+	pullCmd := pull()
+	f.rerr = pullCmd.Rerror()
+	if f.rerr == nil {
+		f.reply, f.shared = encodeReply(pullCmd, result)
+	}
+	rc.mu.Lock()
+	delete(rc.flights, key)
+	if f.shared {
+		if ttl, ok = cacheControlTTL(pullCmd, ttl); ok {
+			rc.setLocked(key, f.reply, ttl)
+		}
+	}
+	rc.mu.Unlock()
+	close(f.done)
+	return pullCmd
+}
+
+func (rc *responseCache) getLocked(key string) (cachedReply, bool) {
+	e, ok := rc.entries[key]
+	if !ok {
+		return cachedReply{}, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.lru.Remove(e)
+		delete(rc.entries, key)
+		return cachedReply{}, false
+	}
+	rc.lru.MoveToFront(e)
+	return entry.reply, true
+}
+
+func (rc *responseCache) setLocked(key string, reply cachedReply, ttl time.Duration) {
+	entry := &cacheEntry{
+		key:     key,
+		reply:   reply,
+		expires: time.Now().Add(ttl),
+	}
+	if e, ok := rc.entries[key]; ok {
+		e.Value = entry
+		rc.lru.MoveToFront(e)
+		return
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.maxEntries {
+		e := rc.lru.Back()
+		rc.lru.Remove(e)
+		delete(rc.entries, e.Value.(*cacheEntry).key)
+		rc.stats.Evicted++
+	}
+}
+
+func (rc *responseCache) getStats() *CacheStats {
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	stats := rc.stats
+	stats.Entries = rc.lru.Len()
+	rc.mu.Unlock()
+	return &stats
+}
+
+// cacheKey returns the URI and the arg encoded by the body codec of the pull, JSON if not set,
+// ok is false if the arg can not be encoded.
+func cacheKey(uri string, arg interface{}, setting []socket.PacketSetting) (key string, ok bool) {
+	packet := socket.GetPacket(setting...)
+	defer socket.PutPacket(packet)
+	packet.SetBody(arg)
+	if packet.BodyCodec() == codec.NilCodecId {
+		packet.SetBodyCodec(codec.ID_JSON)
+	}
+	b, err := packet.MarshalBody()
+	if err != nil {
+		return "", false
+	}
+	return uri + "\x00" + string(packet.BodyCodec()) + goutil.BytesToString(b), true
+}
+
+// cacheControlTTL returns the TTL of the reply according to the CACHE_CONTROL_META_KEY metadata,
+// ok is false if the reply should not be cached.
+func cacheControlTTL(pullCmd tp.PullCmd, ttl time.Duration) (time.Duration, bool) {
+	if meta := pullCmd.InputMeta(); meta != nil {
+		for _, directive := range strings.Split(goutil.BytesToString(meta.Peek(CACHE_CONTROL_META_KEY)), ",") {
+			directive = strings.TrimSpace(directive)
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0, false
+			case strings.HasPrefix(directive, "max-age="):
+				if sec, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+					ttl = time.Duration(sec) * time.Second
+				}
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// encodeReply encodes the result by the body codec of the pull, as the session encodes the body,
+// ok is false if the result can not be encoded.
+func encodeReply(pullCmd tp.PullCmd, result interface{}) (reply cachedReply, ok bool) {
+	if output := pullCmd.Output(); output != nil {
+		reply.bodyCodec = output.BodyCodec()
+	}
+	packet := socket.GetPacket(socket.WithBodyCodec(reply.bodyCodec), socket.WithBody(result))
+	defer socket.PutPacket(packet)
+	body, err := packet.MarshalBody()
+	if err != nil {
+		tp.Warnf("cliSession: can not cache the reply: %s", err.Error())
+		return reply, false
+	}
+	// the body may share the memory of the result.
+	reply.body = append([]byte(nil), body...)
+	return reply, true
+}
+
+// replyFromCache decodes the cached reply into the result by its body codec.
+func replyFromCache(uri string, arg interface{}, result interface{}, reply cachedReply) tp.PullCmd {
+	packet := socket.GetPacket(socket.WithBodyCodec(reply.bodyCodec), socket.WithBody(result))
+	defer socket.PutPacket(packet)
+	var rerr *tp.Rerror
+	if err := packet.UnmarshalBody(reply.body); err != nil {
+		rerr = tp.NewRerror(tp.CodeBadPacket, "Bad Packet", err.Error())
+	}
+	return tp.NewFakePullCmd(uri, arg, result, rerr)
+}
@@ -16,6 +16,9 @@
 package cliSession
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/henrylee2cn/goutil/pool"
@@ -25,22 +28,110 @@ import (
 
 // CliSession client session which is has connection pool
 type CliSession struct {
-	addr string
-	peer tp.Peer
-	pool *pool.Workshop
+	addr      string
+	peer      tp.Peer
+	protoFunc []socket.ProtoFunc
+	pool      sessPool
+	// hold the session until the pull is replied
+	mux bool
+	// options
+	probe       *healthProbe
+	retryPolicy *RetryPolicy
+	breaker     *breaker
+	hedger      *hedger
+	auth        *Authenticator
+	onNewSess   func(tp.Session) *tp.Rerror
+	cache       *responseCache
+	reliable    *ReliablePusher
+	limiter     *limiter
+	dialFunc    DialFunc
+	optMu       sync.RWMutex
+	metrics     *metrics
+	drainer     drainer
+	// the number of the dead sessions evicted from the pool
+	evicted uint64
+	// the number of the sessions dialed to replace the evicted ones
+	redialed uint64
+	// the number of the evicted sessions that have not been replaced yet
+	pendingRedial int64
+}
+
+// Stats session pool stats, with the stats of the options.
+type Stats struct {
+	pool.WorkshopStats
+	// Evicted the number of the dead sessions evicted from the pool.
+	Evicted uint64
+	// Redialed the number of the sessions dialed to replace the evicted ones.
+	Redialed uint64
+	// Breaker the circuit breaker stats, nil if the circuit breaker is disabled.
+	Breaker *BreakerStats
+	// Hedge the hedging stats, nil if the hedging policy is not set.
+	Hedge *HedgeStats
+	// Uris the metrics of the pulls and pushes grouped by the URI path.
+	Uris map[string]URIStats
+	// Cache the response cache stats, nil if the cache is disabled.
+	Cache *CacheStats
+	// Limiter the rate limiter stats, nil if the limiter is disabled.
+	Limiter *LimiterStats
 }
 
 // New creates a client session which is has connection pool.
 func New(peer tp.Peer, addr string, sessMaxQuota int, sessMaxIdleDuration time.Duration, protoFunc ...socket.ProtoFunc) *CliSession {
+	c := newCliSession(peer, addr, protoFunc)
 	newWorkerFunc := func() (pool.Worker, error) {
-		sess, rerr := peer.Dial(addr, protoFunc...)
-		return sess, rerr.ToError()
+		return c.dial()
 	}
+	c.pool = workshopPool{pool.NewWorkshop(sessMaxQuota, sessMaxIdleDuration, newWorkerFunc)}
+	return c
+}
+
+func newCliSession(peer tp.Peer, addr string, protoFunc []socket.ProtoFunc) *CliSession {
 	return &CliSession{
-		addr: addr,
-		peer: peer,
-		pool: pool.NewWorkshop(sessMaxQuota, sessMaxIdleDuration, newWorkerFunc),
+		addr:      addr,
+		peer:      peer,
+		protoFunc: protoFunc,
+		metrics:   newMetrics(),
+	}
+}
+
+// DialFunc dials a new session to the addr.
+type DialFunc func(peer tp.Peer, addr string, protoFunc ...socket.ProtoFunc) (tp.Session, *tp.Rerror)
+
+// SetDialFunc sets the function that dials the new sessions, e.g. over an in-memory connection.
+// Note: If dial is nil, use peer.Dial.
+func (c *CliSession) SetDialFunc(dial DialFunc) {
+	c.optMu.Lock()
+	c.dialFunc = dial
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getDialFunc() DialFunc {
+	c.optMu.RLock()
+	dial := c.dialFunc
+	c.optMu.RUnlock()
+	if dial == nil {
+		return tp.Peer.Dial
 	}
+	return dial
+}
+
+// dial dials a new session for the pool.
+func (c *CliSession) dial() (tp.Session, error) {
+	sess, rerr := c.getDialFunc()(c.peer, c.addr, c.protoFunc...)
+	if rerr == nil {
+		sess.Swap().Store(metricsSwapKey, c.metrics)
+		sess.Swap().Store(cliSessionSwapKey, c)
+		rerr = c.handshake(sess)
+	}
+	if rerr != nil {
+		return nil, rerr.ToError()
+	}
+	if atomic.AddInt64(&c.pendingRedial, -1) >= 0 {
+		atomic.AddUint64(&c.redialed, 1)
+	} else {
+		atomic.AddInt64(&c.pendingRedial, 1)
+	}
+	return sess, nil
 }
 
 // Addr returns the address.
@@ -54,13 +145,30 @@ func (c *CliSession) Peer() tp.Peer {
 }
 
 // Close closes the session.
+// Note: The in-flight calls are killed, use Shutdown to wait for them.
 func (c *CliSession) Close() {
-	c.pool.Close()
+	c.SetHealthProbe("", 0)
+	c.pool.close()
 }
 
 // Stats returns the current session pool stats.
+// Note: It keeps returning the pool.WorkshopStats for compatibility, see DetailedStats for the others.
 func (c *CliSession) Stats() pool.WorkshopStats {
-	return c.pool.Stats()
+	return c.pool.stats()
+}
+
+// DetailedStats returns the current session pool stats, with the stats of the options.
+func (c *CliSession) DetailedStats() Stats {
+	return Stats{
+		WorkshopStats: c.pool.stats(),
+		Evicted:       atomic.LoadUint64(&c.evicted),
+		Redialed:      atomic.LoadUint64(&c.redialed),
+		Breaker:       c.getBreaker().getStats(),
+		Hedge:         c.getHedger().getStats(),
+		Uris:          c.metrics.snapshot(),
+		Cache:         c.getCache().getStats(),
+		Limiter:       c.getLimiter().getStats(),
+	}
 }
 
 // AsyncPull sends a packet and receives reply asynchronously.
@@ -72,28 +180,226 @@ func (c *CliSession) AsyncPull(
 	pullCmdChan chan<- tp.PullCmd,
 	setting ...socket.PacketSetting,
 ) tp.PullCmd {
-	_sess, err := c.pool.Hire()
-	if err != nil {
-		pullCmd := tp.NewFakePullCmd(uri, arg, result, tp.ToRerror(err))
-		if pullCmdChan != nil && cap(pullCmdChan) == 0 {
-			tp.Panicf("*CliSession.AsyncPull(): pullCmdChan channel is unbuffered")
-		}
-		pullCmdChan <- pullCmd
+	start := time.Now()
+	if c.getAuthenticator() == nil {
+		pullCmd, done := c.asyncPull(context.Background(), uri, arg, result, pullCmdChan, setting)
+		tp.Go(func() {
+			<-pullCmd.Done()
+			c.metrics.observe(uri, time.Since(start), pullCmd.Rerror())
+			if done == nil {
+				return
+			}
+			// the authenticator may be set just now.
+			if resent := done(); resent != nil {
+				<-resent.Done()
+				done()
+			}
+		})
 		return pullCmd
 	}
-	sess := _sess.(tp.Session)
-	defer c.pool.Fire(sess)
-	return sess.AsyncPull(uri, arg, result, pullCmdChan, setting...)
+	// the pull may be re-sent after the re-authentication, so the last one is reported by the authedPullCmd.
+	if pullCmdChan != nil && cap(pullCmdChan) == 0 {
+		tp.Panicf("*CliSession.AsyncPull(): pullCmdChan channel is unbuffered")
+	}
+	first, done := c.asyncPull(context.Background(), uri, arg, result, make(chan tp.PullCmd, 1), setting)
+	p := &authedPullCmd{
+		first: first,
+		done:  make(chan struct{}),
+	}
+	tp.Go(func() {
+		last := first
+		<-last.Done()
+		if done != nil {
+			if resent := done(); resent != nil {
+				last = resent
+				<-last.Done()
+				done()
+			}
+		}
+		c.metrics.observe(uri, time.Since(start), last.Rerror())
+		p.last = last
+		close(p.done)
+		if pullCmdChan != nil {
+			pullCmdChan <- p
+		}
+	})
+	return p
+}
+
+// asyncPull sends a packet and receives reply asynchronously.
+// The done must be called after the pullCmd is done, it is nil if the packet is not sent.
+// If the token of the session expired, the done re-authenticates the session and re-sends the packet on it once,
+// then it returns the re-sent pullCmd, which is also sent to the pullCmdChan, and must be called again after it is done.
+// It waits for the rate limits until the ctx is done.
+func (c *CliSession) asyncPull(ctx context.Context, uri string, arg interface{}, result interface{}, pullCmdChan chan<- tp.PullCmd, setting []socket.PacketSetting) (pullCmd tp.PullCmd, done func() (resent tp.PullCmd)) {
+	if rerr := c.drainer.begin(); rerr != nil {
+		return fakeAsyncPull(uri, arg, result, pullCmdChan, rerr), nil
+	}
+	release, rerr := c.getLimiter().acquire(ctx, uri)
+	if rerr != nil {
+		c.drainer.end()
+		return fakeAsyncPull(uri, arg, result, pullCmdChan, rerr), nil
+	}
+	b := c.getBreaker()
+	probe, rerr := b.allow()
+	if rerr != nil {
+		release()
+		c.drainer.end()
+		return fakeAsyncPull(uri, arg, result, pullCmdChan, rerr), nil
+	}
+	sess, rerr := c.hire()
+	if rerr != nil {
+		b.done(probe, rerr)
+		release()
+		c.drainer.end()
+		return fakeAsyncPull(uri, arg, result, pullCmdChan, rerr), nil
+	}
+	start := time.Now()
+	pullCmd = sess.AsyncPull(uri, arg, result, pullCmdChan, setting...)
+	if !c.mux {
+		c.fire(sess)
+	}
+	var checked bool
+	return pullCmd, func() tp.PullCmd {
+		if !checked {
+			checked = true
+			if c.reauthenticate(sess, pullCmd.Rerror(), start) {
+				pullCmd = sess.AsyncPull(uri, arg, result, pullCmdChan, setting...)
+				return pullCmd
+			}
+		}
+		if c.mux {
+			c.fire(sess)
+		}
+		b.done(probe, pullCmd.Rerror())
+		release()
+		c.drainer.end()
+		return nil
+	}
+}
+
+// fakeAsyncPull returns a failed PullCmd and sends it to the pullCmdChan.
+func fakeAsyncPull(uri string, arg interface{}, result interface{}, pullCmdChan chan<- tp.PullCmd, rerr *tp.Rerror) tp.PullCmd {
+	pullCmd := tp.NewFakePullCmd(uri, arg, result, rerr)
+	if pullCmdChan != nil && cap(pullCmdChan) == 0 {
+		tp.Panicf("*CliSession.AsyncPull(): pullCmdChan channel is unbuffered")
+	}
+	pullCmdChan <- pullCmd
+	return pullCmd
 }
 
 // Pull sends a packet and receives reply.
 // Note:
 // If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
-// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure;
+// If the retry policy is set, it is retried according to the policy.
 func (c *CliSession) Pull(uri string, arg interface{}, result interface{}, setting ...socket.PacketSetting) tp.PullCmd {
-	pullCmd := c.AsyncPull(uri, arg, result, make(chan tp.PullCmd, 1), setting...)
-	<-pullCmd.Done()
-	return pullCmd
+	return c.PullContext(context.Background(), uri, arg, result, setting...)
+}
+
+// PullContext sends a packet and receives reply, it returns when the ctx is done.
+// The remaining time of the ctx deadline is sent to the peer with the TIMEOUT_META_KEY metadata.
+// Note:
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure;
+// If the retry policy is set, it is retried according to the policy;
+// If the hedging policy is set, the slow pull is hedged with another pooled session;
+// If the cache is set, the reply may be from the cache or shared with a concurrent identical pull;
+// If the limiter is set, it waits for the rate limits until the ctx is done, or fails with CodeRateLimited;
+// If the ctx is done before the reply, the late reply may still be written into the result.
+func (c *CliSession) PullContext(ctx context.Context, uri string, arg interface{}, result interface{}, setting ...socket.PacketSetting) tp.PullCmd {
+	return c.getCache().do(ctx, uri, arg, result, setting, func() tp.PullCmd {
+		return c.pullContext(ctx, uri, arg, result, setting)
+	})
+}
+
+func (c *CliSession) pullContext(ctx context.Context, uri string, arg interface{}, result interface{}, setting []socket.PacketSetting) (pullCmd tp.PullCmd) {
+	if rerr := c.drainer.begin(); rerr != nil {
+		return tp.NewFakePullCmd(uri, arg, result, rerr)
+	}
+	start := time.Now()
+	defer func() {
+		c.metrics.observe(uri, time.Since(start), pullCmd.Rerror())
+		c.drainer.end()
+	}()
+	release, rerr := c.getLimiter().acquire(ctx, uri)
+	if rerr != nil {
+		return tp.NewFakePullCmd(uri, arg, result, rerr)
+	}
+	defer release()
+	policy := c.getRetryPolicy()
+	for attempt := 1; ; attempt++ {
+		var sent bool
+		pullCmd, sent = c.pullAttempt(ctx, uri, arg, result, setting)
+		if !policy.shouldRetry(attempt, uri, sent, pullCmd.Rerror()) {
+			return pullCmd
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return tp.NewFakePullCmd(uri, arg, result, toContextRerror(ctx.Err()))
+		}
+	}
+}
+
+// pullOnce hires a session by the hire and pulls once, sent reports whether the packet has been sent.
+// If the token of the session expired, it is re-authenticated and the packet is re-sent on it once.
+func (c *CliSession) pullOnce(ctx context.Context, uri string, arg interface{}, result interface{}, setting []socket.PacketSetting, hire func(context.Context) (tp.Session, *tp.Rerror)) (pullCmd tp.PullCmd, sent bool) {
+	b := c.getBreaker()
+	probe, rerr := b.allow()
+	if rerr != nil {
+		return tp.NewFakePullCmd(uri, arg, result, rerr), false
+	}
+	sess, rerr := hire(ctx)
+	if rerr == nil {
+		setting, rerr = withTimeoutMeta(ctx, setting)
+		if rerr != nil {
+			c.fire(sess)
+		}
+	}
+	if rerr != nil {
+		b.done(probe, rerr)
+		return tp.NewFakePullCmd(uri, arg, result, rerr), false
+	}
+	start := time.Now()
+	pullCmd = sess.AsyncPull(uri, arg, result, make(chan tp.PullCmd, 1), setting...)
+	if !c.mux {
+		c.fire(sess)
+	}
+	replied := waitPullCmd(ctx, pullCmd)
+	if replied && c.reauthenticate(sess, pullCmd.Rerror(), start) {
+		// re-send on the re-authenticated session, which is still hired in the mux mode.
+		pullCmd = sess.AsyncPull(uri, arg, result, make(chan tp.PullCmd, 1), setting...)
+		replied = waitPullCmd(ctx, pullCmd)
+	}
+	if c.mux {
+		if replied {
+			c.fire(sess)
+		} else {
+			sentCmd := pullCmd
+			tp.Go(func() {
+				<-sentCmd.Done()
+				c.fire(sess)
+			})
+		}
+	}
+	if !replied {
+		pullCmd = tp.NewFakePullCmd(uri, arg, result, toContextRerror(ctx.Err()))
+	}
+	b.done(probe, pullCmd.Rerror())
+	return pullCmd, true
+}
+
+// waitPullCmd waits for the reply of the pullCmd, it returns false if the ctx is done first.
+func waitPullCmd(ctx context.Context, pullCmd tp.PullCmd) bool {
+	select {
+	case <-pullCmd.Done():
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // Push sends a packet, but do not receives reply.
@@ -101,11 +407,41 @@ func (c *CliSession) Pull(uri string, arg interface{}, result interface{}, setti
 // If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
 // If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
 func (c *CliSession) Push(uri string, arg interface{}, setting ...socket.PacketSetting) *tp.Rerror {
-	_sess, err := c.pool.Hire()
-	if err != nil {
-		return tp.ToRerror(err)
+	return c.PushContext(context.Background(), uri, arg, setting...)
+}
+
+// PushContext sends a packet, but do not receives reply, it gives up waiting for a session when the ctx is done.
+// The remaining time of the ctx deadline is sent to the peer with the TIMEOUT_META_KEY metadata.
+// Note:
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
+func (c *CliSession) PushContext(ctx context.Context, uri string, arg interface{}, setting ...socket.PacketSetting) (rerr *tp.Rerror) {
+	if rerr = c.drainer.begin(); rerr != nil {
+		return rerr
+	}
+	start := time.Now()
+	defer func() {
+		c.metrics.observe(uri, time.Since(start), rerr)
+		c.drainer.end()
+	}()
+	release, rerr := c.getLimiter().acquire(ctx, uri)
+	if rerr != nil {
+		return rerr
+	}
+	defer release()
+	b := c.getBreaker()
+	probe, rerr := b.allow()
+	if rerr != nil {
+		return rerr
+	}
+	sess, rerr := c.hireContext(ctx)
+	if rerr == nil {
+		setting, rerr = withTimeoutMeta(ctx, setting)
+		if rerr == nil {
+			rerr = sess.Push(uri, arg, setting...)
+		}
+		c.fire(sess)
 	}
-	sess := _sess.(tp.Session)
-	defer c.pool.Fire(sess)
-	return sess.Push(uri, arg, setting...)
+	b.done(probe, rerr)
+	return rerr
 }
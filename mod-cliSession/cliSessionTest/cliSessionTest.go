@@ -0,0 +1,348 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cliSessionTest provides an in-process fake server for testing the users of CliSession,
+// which is connected with the clients by net.Pipe, without opening any port.
+package cliSessionTest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+	cliSession "github.com/henrylee2cn/tp-ext/mod-cliSession"
+)
+
+// Addr the fake address of the CliSession created by Server.NewCliSession.
+const Addr = "pipe"
+
+type (
+	// Server the fake server.
+	Server struct {
+		peer     tp.Peer
+		pulls    map[string]*Route
+		pushes   map[string]PushHandler
+		packets  []Packet
+		sessions []tp.Session
+		cliPeers []tp.Peer
+		mu       sync.Mutex
+	}
+	// PullHandler handles the pull, the arg can be bound by ctx.Bind.
+	PullHandler func(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror)
+	// PushHandler handles the push, the arg can be bound by ctx.Bind.
+	PushHandler func(ctx tp.UnknownPushCtx) *tp.Rerror
+	// Reply the scripted reply of the pull.
+	Reply struct {
+		Result interface{}
+		Rerror *tp.Rerror
+		// Delay replies after the delay.
+		Delay time.Duration
+	}
+	// Packet the packet received by the server.
+	Packet struct {
+		// Ptype tp.TypePull or tp.TypePush.
+		Ptype     byte
+		Uri       string
+		Meta      map[string]string
+		Body      []byte
+		SessionId string
+	}
+)
+
+// NewServer creates a fake server, the plugins are registered to its peer.
+// The pulls and pushes of the URIs without handlers are replied with tp.CodeNotFound.
+func NewServer(plugin ...tp.Plugin) *Server {
+	s := &Server{
+		peer:   tp.NewPeer(tp.PeerConfig{}, plugin...),
+		pulls:  make(map[string]*Route),
+		pushes: make(map[string]PushHandler),
+	}
+	s.peer.SetUnknownPull(s.handlePull)
+	s.peer.SetUnknownPush(s.handlePush)
+	return s
+}
+
+// Peer returns the peer of the server.
+func (s *Server) Peer() tp.Peer {
+	return s.peer
+}
+
+// HandlePull registers the handler of the pull uri.
+func (s *Server) HandlePull(uri string, handler PullHandler) *Route {
+	return s.route(uri, &Route{handler: handler})
+}
+
+// ReplyPull registers the scripted replies of the pull uri,
+// which are replied in order, and the last one is repeated.
+func (s *Server) ReplyPull(uri string, replies ...Reply) *Route {
+	return s.route(uri, &Route{replies: replies})
+}
+
+// HandlePush registers the handler of the push uri.
+func (s *Server) HandlePush(uri string, handler PushHandler) {
+	s.mu.Lock()
+	s.pushes[uri] = handler
+	s.mu.Unlock()
+}
+
+func (s *Server) route(uri string, r *Route) *Route {
+	s.mu.Lock()
+	s.pulls[uri] = r
+	s.mu.Unlock()
+	return r
+}
+
+// Dial creates an in-process connection to the server, and returns the session of the client peer.
+// It can be used as the cliSession.DialFunc.
+// Note: The PostDial plugins of the client peer are run after the session is served,
+// so those who send or receive packets on the PreSession are not supported.
+func (s *Server) Dial(peer tp.Peer, _ string, protoFunc ...socket.ProtoFunc) (tp.Session, *tp.Rerror) {
+	srvConn, cliConn := net.Pipe()
+	srvSess, err := s.peer.ServeConn(srvConn, protoFunc...)
+	if err != nil {
+		cliConn.Close()
+		return nil, tp.NewRerror(tp.CodeDialFailed, "Dial Failed", err.Error())
+	}
+	sess, err := peer.ServeConn(cliConn, protoFunc...)
+	if err != nil {
+		srvSess.Close()
+		return nil, tp.NewRerror(tp.CodeDialFailed, "Dial Failed", err.Error())
+	}
+	if rerr := postDial(peer, sess); rerr != nil {
+		sess.Close()
+		srvSess.Close()
+		return nil, rerr
+	}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, srvSess)
+	s.mu.Unlock()
+	return sess, nil
+}
+
+// postDial runs the PostDial plugins of the peer, as the peer.Dial does,
+// since the peer.ServeConn runs its PostAccept plugins instead.
+func postDial(peer tp.Peer, sess tp.Session) *tp.Rerror {
+	preSess, ok := sess.(tp.PreSession)
+	if !ok {
+		return nil
+	}
+	for _, plugin := range peer.PluginContainer().GetAll() {
+		if p, ok := plugin.(tp.PostDialPlugin); ok {
+			if rerr := p.PostDial(preSess); rerr != nil {
+				return rerr
+			}
+		}
+	}
+	return nil
+}
+
+// NewCliSession creates a CliSession connected with the server, the plugins are registered to its peer.
+// Note: The peer is closed when the server is closed.
+func (s *Server) NewCliSession(sessMaxQuota int, plugin ...tp.Plugin) *cliSession.CliSession {
+	peer := tp.NewPeer(tp.PeerConfig{}, plugin...)
+	s.mu.Lock()
+	s.cliPeers = append(s.cliPeers, peer)
+	s.mu.Unlock()
+	cli := cliSession.New(peer, Addr, sessMaxQuota, time.Minute)
+	cli.SetDialFunc(s.Dial)
+	return cli
+}
+
+// CloseSessions closes all the connections, e.g. to simulate the server restarting.
+func (s *Server) CloseSessions() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = nil
+	s.mu.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+}
+
+// Close closes the server, and the client peers created by NewCliSession.
+func (s *Server) Close() {
+	s.CloseSessions()
+	s.mu.Lock()
+	cliPeers := s.cliPeers
+	s.cliPeers = nil
+	s.mu.Unlock()
+	for _, peer := range cliPeers {
+		peer.Close()
+	}
+	s.peer.Close()
+}
+
+// Packets returns the packets received, in the order of arrival.
+func (s *Server) Packets() []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Packet(nil), s.packets...)
+}
+
+// Received returns the packets of the uri received.
+func (s *Server) Received(uri string) []Packet {
+	var r []Packet
+	for _, p := range s.Packets() {
+		if p.Uri == uri {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// Reset clears the packets received.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.packets = nil
+	s.mu.Unlock()
+}
+
+// AssertReceived fails the test if the number of the packets of the uri received is not n.
+func (s *Server) AssertReceived(t testing.TB, uri string, n int) {
+	t.Helper()
+	if got := len(s.Received(uri)); got != n {
+		t.Fatalf("cliSessionTest: expect %d packets of %s received, but get %d", n, uri, got)
+	}
+}
+
+// AssertMeta fails the test if the last packet of the uri received has not the metadata key=value.
+func (s *Server) AssertMeta(t testing.TB, uri, key, value string) {
+	t.Helper()
+	packets := s.Received(uri)
+	if len(packets) == 0 {
+		t.Fatalf("cliSessionTest: no packet of %s received", uri)
+	}
+	if got := packets[len(packets)-1].Meta[key]; got != value {
+		t.Fatalf("cliSessionTest: expect the metadata %s=%q of %s, but get %q", key, value, uri, got)
+	}
+}
+
+type inputCtx interface {
+	Path() string
+	Seq() string
+	VisitMeta(f func(key, value []byte))
+	Session() tp.Session
+}
+
+func (s *Server) record(ptype byte, ctx inputCtx, body []byte) {
+	p := Packet{
+		Ptype:     ptype,
+		Uri:       ctx.Path(),
+		Meta:      make(map[string]string),
+		Body:      append([]byte(nil), body...),
+		SessionId: ctx.Session().Id(),
+	}
+	ctx.VisitMeta(func(key, value []byte) {
+		p.Meta[string(key)] = string(value)
+	})
+	s.mu.Lock()
+	s.packets = append(s.packets, p)
+	s.mu.Unlock()
+}
+
+func (s *Server) handlePull(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
+	s.record(tp.TypePull, ctx, ctx.InputBodyBytes())
+	s.mu.Lock()
+	r := s.pulls[ctx.Path()]
+	s.mu.Unlock()
+	if r == nil {
+		return nil, tp.NewRerror(tp.CodeNotFound, "Not Found", ctx.Path())
+	}
+	return r.serve(ctx)
+}
+
+func (s *Server) handlePush(ctx tp.UnknownPushCtx) *tp.Rerror {
+	s.record(tp.TypePush, ctx, ctx.InputBodyBytes())
+	s.mu.Lock()
+	handler := s.pushes[ctx.Path()]
+	s.mu.Unlock()
+	if handler == nil {
+		return nil
+	}
+	return handler(ctx)
+}
+
+// Route the handler of a pull URI, with the latency and failure injection.
+type Route struct {
+	handler  PullHandler
+	replies  []Reply
+	latency  time.Duration
+	failures []*tp.Rerror
+	calls    int
+	mu       sync.Mutex
+}
+
+// Latency delays each reply by d.
+func (r *Route) Latency(d time.Duration) *Route {
+	r.mu.Lock()
+	r.latency = d
+	r.mu.Unlock()
+	return r
+}
+
+// Fail replies the next times pulls with the rerr.
+func (r *Route) Fail(rerr *tp.Rerror, times int) *Route {
+	r.mu.Lock()
+	for i := 0; i < times; i++ {
+		r.failures = append(r.failures, rerr)
+	}
+	r.mu.Unlock()
+	return r
+}
+
+// Calls returns the number of the pulls handled.
+func (r *Route) Calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func (r *Route) serve(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
+	r.mu.Lock()
+	r.calls++
+	latency := r.latency
+	var (
+		failure *tp.Rerror
+		reply   *Reply
+	)
+	if len(r.failures) > 0 {
+		failure = r.failures[0]
+		r.failures = r.failures[1:]
+	} else if len(r.replies) > 0 {
+		reply = &r.replies[0]
+		if len(r.replies) > 1 {
+			r.replies = r.replies[1:]
+		}
+	}
+	r.mu.Unlock()
+	if reply != nil {
+		latency += reply.Delay
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	switch {
+	case failure != nil:
+		return nil, failure
+	case reply != nil:
+		return reply.Result, reply.Rerror
+	case r.handler != nil:
+		return r.handler(ctx)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,143 @@
+package cliSessionTest_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	cliSession "github.com/henrylee2cn/tp-ext/mod-cliSession"
+	"github.com/henrylee2cn/tp-ext/mod-cliSession/cliSessionTest"
+)
+
+type Arg struct {
+	A int
+	B int
+}
+
+// dialPlugin counts the dialed sessions.
+type dialPlugin struct {
+	dialed int32
+}
+
+func (*dialPlugin) Name() string {
+	return "dial"
+}
+
+func (p *dialPlugin) PostDial(tp.PreSession) *tp.Rerror {
+	atomic.AddInt32(&p.dialed, 1)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	srv := cliSessionTest.NewServer()
+	defer srv.Close()
+	srv.HandlePull("/add", func(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
+		var arg Arg
+		if _, err := ctx.Bind(&arg); err != nil {
+			return nil, tp.NewRerror(tp.CodeBadPacket, "Bad Packet", err.Error())
+		}
+		return arg.A + arg.B, nil
+	})
+	plugin := new(dialPlugin)
+	cli := srv.NewCliSession(10, plugin)
+	defer cli.Close()
+
+	var result int
+	rerr := cli.Pull("/add", &Arg{A: 1, B: 2}, &result).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if result != 3 {
+		t.Fatalf("expect 3, but get %d", result)
+	}
+	if n := atomic.LoadInt32(&plugin.dialed); n != 1 {
+		t.Fatalf("expect the PostDial plugin run once, but get %d", n)
+	}
+	rerr = cli.Pull("/unknown", &Arg{}, &result).Rerror()
+	if rerr == nil || rerr.Code != tp.CodeNotFound {
+		t.Fatalf("expect CodeNotFound, but get %v", rerr)
+	}
+	cli.Push("/notify", &Arg{A: 1})
+	time.Sleep(100 * time.Millisecond)
+	srv.AssertReceived(t, "/add", 1)
+	srv.AssertReceived(t, "/notify", 1)
+	if p := srv.Received("/notify")[0]; p.Ptype != tp.TypePush {
+		t.Fatalf("expect the push packet, but get the type %d", p.Ptype)
+	}
+}
+
+func TestReplyPull(t *testing.T) {
+	t.Parallel()
+	srv := cliSessionTest.NewServer()
+	defer srv.Close()
+	route := srv.ReplyPull("/echo",
+		cliSessionTest.Reply{Result: "first"},
+		cliSessionTest.Reply{Result: "second", Delay: 50 * time.Millisecond},
+	).Fail(tp.NewRerror(503, "Unavailable", ""), 1)
+	cli := srv.NewCliSession(10)
+	defer cli.Close()
+
+	var result string
+	rerr := cli.Pull("/echo", nil, &result).Rerror()
+	if rerr == nil || rerr.Code != 503 {
+		t.Fatalf("expect the injected failure, but get %v", rerr)
+	}
+	for _, expect := range []string{"first", "second", "second"} {
+		if rerr = cli.Pull("/echo", nil, &result).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+		if result != expect {
+			t.Fatalf("expect %q, but get %q", expect, result)
+		}
+	}
+	if route.Calls() != 4 {
+		t.Fatalf("expect 4 calls, but get %d", route.Calls())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	t.Parallel()
+	srv := cliSessionTest.NewServer()
+	defer srv.Close()
+	srv.ReplyPull("/slow", cliSessionTest.Reply{Result: "ok"}).Latency(200 * time.Millisecond)
+	cli := srv.NewCliSession(10)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var result string
+	rerr := cli.PullContext(ctx, "/slow", nil, &result).Rerror()
+	if rerr == nil || rerr.Code != cliSession.CodeDeadlineExceeded {
+		t.Fatalf("expect CodeDeadlineExceeded, but get %v", rerr)
+	}
+	srv.AssertReceived(t, "/slow", 1)
+	if srv.Received("/slow")[0].Meta[cliSession.TIMEOUT_META_KEY] == "" {
+		t.Fatalf("expect the %s metadata", cliSession.TIMEOUT_META_KEY)
+	}
+}
+
+func TestCloseSessions(t *testing.T) {
+	t.Parallel()
+	srv := cliSessionTest.NewServer()
+	defer srv.Close()
+	srv.ReplyPull("/ping", cliSessionTest.Reply{Result: "pong"})
+	cli := srv.NewCliSession(1)
+	defer cli.Close()
+
+	var result string
+	if rerr := cli.Pull("/ping", nil, &result).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	srv.CloseSessions()
+	time.Sleep(100 * time.Millisecond)
+	if rerr := cli.Pull("/ping", nil, &result).Rerror(); rerr != nil {
+		t.Fatalf("expect redialed, but get %v", rerr)
+	}
+	packets := srv.Received("/ping")
+	if len(packets) != 2 || packets[0].SessionId == packets[1].SessionId {
+		t.Fatalf("expect 2 pulls on different sessions, but get %v", packets)
+	}
+}
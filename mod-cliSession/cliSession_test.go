@@ -1,6 +1,14 @@
 package cliSession_test
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,3 +66,907 @@ func TestCliSession(t *testing.T) {
 	cli.Close()
 	time.Sleep(time.Second * 3)
 }
+
+func TestClusterSession(t *testing.T) {
+	addrs := []string{":9091", ":9092"}
+	for _, port := range []uint16{9091, 9092} {
+		srv := tp.NewPeer(tp.PeerConfig{
+			ListenPort: port,
+		})
+		srv.RoutePull(new(P))
+		go srv.ListenAndServe()
+	}
+	time.Sleep(time.Second)
+
+	balancers := []cliSession.Balancer{
+		cliSession.NewRoundRobinBalancer(),
+		cliSession.NewWeightedRandomBalancer(map[string]int{":9091": 1, ":9092": 3}),
+		cliSession.NewLeastInflightBalancer(),
+		cliSession.NewConsistentHashBalancer(0),
+	}
+	for _, balancer := range balancers {
+		cli := cliSession.NewCluster(
+			tp.NewPeer(tp.PeerConfig{}),
+			addrs,
+			balancer,
+			100,
+			time.Second*5,
+		)
+		var result int
+		for i := 0; i < 10; i++ {
+			rerr := cli.Pull("/p/divide", &Arg{
+				A: i,
+				B: 2,
+			}, &result, cliSession.WithHashKey("user-1")).Rerror()
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if result != i/2 {
+				t.Fatalf("%s: expect %d, but get %d", balancer.Name(), i/2, result)
+			}
+		}
+		t.Logf("%s: %+v", balancer.Name(), cli.Stats())
+		cli.Close()
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9093,
+	})
+	srv.RoutePull(new(P))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9093",
+		100,
+		time.Second*5,
+	)
+	cli.SetHealthProbe("", time.Second)
+	var result int
+	rerr := cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	// kill the pooled sessions, they should be evicted and redialed.
+	srv.RangeSession(func(sess tp.Session) bool {
+		sess.Close()
+		return true
+	})
+	time.Sleep(time.Second * 3)
+	rerr = cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	t.Logf("%+v", cli.Stats())
+	cli.Close()
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9094",
+		100,
+		time.Second*5,
+	)
+	cli.SetRetryPolicy(&cliSession.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond * 500,
+		Jitter:         0.2,
+		IdempotentUris: []string{"/p/divide"},
+	})
+	// the server is started after the first attempt fails.
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		srv := tp.NewPeer(tp.PeerConfig{
+			ListenPort: 9094,
+		})
+		srv.RoutePull(new(P))
+		srv.ListenAndServe()
+	}()
+	var result int
+	rerr := cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if result != 5 {
+		t.Fatalf("expect 5, but get %d", result)
+	}
+	cli.Close()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9095",
+		100,
+		time.Second*5,
+	)
+	cli.SetCircuitBreaker(&cliSession.BreakerConfig{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         time.Second,
+		OnStateChange: func(addr string, from, to cliSession.BreakerState) {
+			t.Logf("circuit breaker of %s: %s -> %s", addr, from, to)
+		},
+	})
+	// no server, trip the breaker.
+	var result int
+	for i := 0; i < 3; i++ {
+		cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result)
+	}
+	rerr := cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror()
+	if rerr == nil || rerr.Code != cliSession.CodeCircuitOpen {
+		t.Fatalf("expect circuit open, but get %v", rerr)
+	}
+	if state := cli.DetailedStats().Breaker.State; state != cliSession.BreakerOpen {
+		t.Fatalf("expect open, but get %s", state)
+	}
+
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9095,
+	})
+	srv.RoutePull(new(P))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second * 2)
+
+	// half-open probe succeeds and closes the breaker.
+	rerr = cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if state := cli.DetailedStats().Breaker.State; state != cliSession.BreakerClosed {
+		t.Fatalf("expect closed, but get %s", state)
+	}
+	cli.Close()
+}
+
+type S struct{ tp.PullCtx }
+
+type SleepArg struct {
+	D time.Duration
+}
+
+func (s *S) Sleep(arg *SleepArg) (int64, *tp.Rerror) {
+	deadline, ok := cliSession.Deadline(s)
+	if !ok {
+		return 0, tp.NewRerror(400, "no deadline", "")
+	}
+	time.Sleep(arg.D)
+	return int64(deadline.Sub(time.Now()) / time.Millisecond), nil
+}
+
+func TestPullContext(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9096,
+	})
+	srv.RoutePull(new(S), cliSession.NewDeadlinePlugin())
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9096",
+		100,
+		time.Second*5,
+	)
+	var left int64
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	rerr := cli.PullContext(ctx, "/s/sleep", &SleepArg{D: time.Millisecond * 100}, &left).Rerror()
+	cancel()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	t.Logf("remaining deadline on server: %dms", left)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*500)
+	rerr = cli.PullContext(ctx, "/s/sleep", &SleepArg{D: time.Second * 2}, &left).Rerror()
+	cancel()
+	if rerr == nil || rerr.Code != cliSession.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, but get %v", rerr)
+	}
+	cli.Close()
+}
+
+func TestFileResolver(t *testing.T) {
+	for _, port := range []uint16{9097, 9098} {
+		srv := tp.NewPeer(tp.PeerConfig{
+			ListenPort: port,
+		})
+		srv.RoutePull(new(P))
+		go srv.ListenAndServe()
+	}
+	time.Sleep(time.Second)
+
+	f, err := ioutil.TempFile("", "addrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := f.Name() + ".json"
+	f.Close()
+	os.Remove(f.Name())
+	defer os.Remove(filename)
+	ioutil.WriteFile(filename, []byte(`[":9097"]`), 0644)
+
+	cli, err := cliSession.NewClusterWithResolver(
+		tp.NewPeer(tp.PeerConfig{}),
+		cliSession.NewFileResolver(filename, time.Millisecond*200),
+		nil,
+		100,
+		time.Second*5,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filename, []byte(`[":9098"]`), 0644)
+	var result int
+	for i := 0; i < 10; i++ {
+		rerr := cli.Pull("/p/divide", &Arg{A: i, B: 2}, &result).Rerror()
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		t.Logf("%v: %d/2=%d", cli.Addrs(), i, result)
+		time.Sleep(time.Millisecond * 100)
+	}
+	if addrs := cli.Addrs(); len(addrs) != 1 || addrs[0] != ":9098" {
+		t.Fatalf("expect [:9098], but get %v", addrs)
+	}
+	cli.Close()
+
+	// the addresses are not updated after closed
+	ioutil.WriteFile(filename, []byte(`[":9097"]`), 0644)
+	time.Sleep(time.Millisecond * 500)
+	if addrs := cli.Addrs(); len(addrs) != 1 || addrs[0] != ":9098" {
+		t.Fatalf("expect [:9098] after closed, but get %v", addrs)
+	}
+}
+
+func TestMux(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9100,
+	})
+	srv.RoutePull(new(P))
+	srv.RoutePull(new(S))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.NewMux(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9100",
+		10,
+		100,
+		time.Second*5,
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var result int
+			rerr := cli.Pull("/p/divide", &Arg{A: i, B: 2}, &result).Rerror()
+			if rerr != nil {
+				t.Error(rerr)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := cli.Stats()
+	t.Logf("%+v", stats)
+	if stats.Worker > 10 {
+		t.Fatalf("expect at most 10 sessions, but get %d", stats.Worker)
+	}
+	cli.Close()
+
+	// the calls wait when all the sessions are at capacity.
+	cli = cliSession.NewMux(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9100",
+		1,
+		2,
+		time.Second*5,
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			var left int64
+			rerr := cli.PullContext(ctx, "/s/sleep", &SleepArg{D: time.Millisecond * 500}, &left).Rerror()
+			if rerr != nil {
+				t.Error(rerr)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 200)
+	stats = cli.Stats()
+	t.Logf("%+v", stats)
+	if stats.Worker != 1 || stats.MaxLoad != 2 {
+		t.Fatalf("expect 1 session carrying 2 calls, but get %+v", stats)
+	}
+	wg.Wait()
+	cli.Close()
+}
+
+// H the handler whose odd calls are slow.
+type H struct {
+	tp.PullCtx
+}
+
+var hedgeCalls int32
+
+func (h *H) Slow(arg *SleepArg) (int32, *tp.Rerror) {
+	n := atomic.AddInt32(&hedgeCalls, 1)
+	if n%2 == 1 {
+		time.Sleep(arg.D)
+	}
+	return n, nil
+}
+
+func TestHedge(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9101,
+	})
+	srv.RoutePull(new(H))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9101",
+		100,
+		time.Second*5,
+	)
+	cli.SetHedgePolicy(&cliSession.HedgePolicy{
+		Uris:          []string{"/h/slow"},
+		Delay:         time.Millisecond * 100,
+		BudgetPercent: 100,
+	})
+	var n int32
+	start := time.Now()
+	pullCmd := cli.Pull("/h/slow", &SleepArg{D: time.Second * 2}, &n)
+	if rerr := pullCmd.Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	cost := time.Since(start)
+	t.Logf("call %d returned in %v", n, cost)
+	if n%2 != 0 || cost >= time.Second {
+		t.Fatalf("expect the hedged call to win, but get call %d in %v", n, cost)
+	}
+	if r, _ := pullCmd.Result(); r != &n {
+		t.Fatalf("expect the result of the caller, but get %v", r)
+	}
+	stats := cli.DetailedStats()
+	t.Logf("%+v", stats.Hedge)
+	if stats.Hedge.Hedged != 1 || stats.Hedge.Won != 1 {
+		t.Fatalf("expect 1 hedged and won, but get %+v", stats.Hedge)
+	}
+	// the hedged call is sent on another session
+	if stats.Worker != 2 {
+		t.Fatalf("expect 2 sessions, but get %d", stats.Worker)
+	}
+	cli.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9102,
+	})
+	srv.RoutePull(new(P))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}, cliSession.NewMetricsPlugin()),
+		":9102",
+		100,
+		time.Second*5,
+	)
+	var result int
+	for i := 0; i < 10; i++ {
+		cli.Pull("/p/divide", &Arg{A: i, B: i % 2}, &result)
+	}
+	// the async pulls are counted too
+	pullCmdChan := make(chan tp.PullCmd, 2)
+	for i := 0; i < 2; i++ {
+		cli.AsyncPull("/p/divide", &Arg{A: i, B: i % 2}, new(int), pullCmdChan)
+	}
+	for i := 0; i < 2; i++ {
+		<-pullCmdChan
+	}
+	time.Sleep(time.Millisecond * 100)
+	stats := cli.DetailedStats().Uris["/p/divide"]
+	t.Logf("%+v", stats)
+	var failed uint64
+	for _, n := range stats.Errors {
+		failed += n
+	}
+	if stats.Calls != 12 || failed != 6 || stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Fatalf("expect 12 calls with 6 errors, but get %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	cli.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	t.Log(body)
+	if !strings.Contains(body, `cli_session_calls_total{addr=":9102",uri="/p/divide"} 12`) {
+		t.Fatal("expect the calls in the metrics")
+	}
+	cli.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9103,
+	})
+	srv.RoutePull(new(S))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	newCli := func() *cliSession.CliSession {
+		return cliSession.New(
+			tp.NewPeer(tp.PeerConfig{}),
+			":9103",
+			100,
+			time.Second*5,
+		)
+	}
+	pullAll := func(cli *cliSession.CliSession, n int, d time.Duration) *sync.WaitGroup {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var left int64
+				cli.Pull("/s/sleep", &SleepArg{D: d}, &left)
+			}()
+		}
+		time.Sleep(time.Millisecond * 100)
+		return &wg
+	}
+
+	// the in-flight calls finish
+	cli := newCli()
+	wg := pullAll(cli, 3, time.Millisecond*500)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	abandoned := cli.Shutdown(ctx)
+	cancel()
+	wg.Wait()
+	if abandoned != 0 {
+		t.Fatalf("expect 0 abandoned calls, but get %d", abandoned)
+	}
+	var left int64
+	rerr := cli.Pull("/s/sleep", &SleepArg{}, &left).Rerror()
+	if rerr == nil || rerr.Code != tp.CodeConnClosed {
+		t.Fatalf("expect connection closed after shutdown, but get %v", rerr)
+	}
+
+	// the in-flight calls are abandoned
+	cli = newCli()
+	wg = pullAll(cli, 3, time.Second*2)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	abandoned = cli.Shutdown(ctx)
+	cancel()
+	wg.Wait()
+	if abandoned != 3 {
+		t.Fatalf("expect 3 abandoned calls, but get %d", abandoned)
+	}
+}
+
+func TestPullAll(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9104,
+	})
+	srv.RoutePull(new(P))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9104",
+		100,
+		time.Second*5,
+	)
+	newReqs := func(bs ...int) []cliSession.PullReq {
+		reqs := make([]cliSession.PullReq, len(bs))
+		for i, b := range bs {
+			reqs[i] = cliSession.PullReq{
+				Uri:    "/p/divide",
+				Arg:    &Arg{A: 12, B: b},
+				Result: new(int),
+			}
+		}
+		return reqs
+	}
+	ctx := context.Background()
+
+	reqs := newReqs(1, 0, 2, 0, 3, 4)
+	pullCmds, rerr := cli.PullAll(ctx, reqs, cliSession.ScatterOptions{Concurrency: 2})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	for i, pullCmd := range pullCmds {
+		b := reqs[i].Arg.(*Arg).B
+		if (b == 0) != (pullCmd.Rerror() != nil) {
+			t.Fatalf("unexpected reply of 12/%d: %v", b, pullCmd.Rerror())
+		}
+		if b != 0 && *reqs[i].Result.(*int) != 12/b {
+			t.Fatalf("expect 12/%d=%d, but get %d", b, 12/b, *reqs[i].Result.(*int))
+		}
+	}
+
+	_, rerr = cli.PullAll(ctx, newReqs(0, 0, 1), cliSession.ScatterOptions{Mode: cliSession.GatherFirstSuccess})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	_, rerr = cli.PullAll(ctx, newReqs(1, 0, 0), cliSession.ScatterOptions{Mode: cliSession.GatherQuorum, Quorum: 2})
+	if rerr == nil || rerr.Code != cliSession.CodeQuorumFailed {
+		t.Fatalf("expect quorum failed, but get %v", rerr)
+	}
+
+	pullCmds, rerr = cli.Scatter(ctx, "/p/divide",
+		[]interface{}{&Arg{A: 1, B: 1}, &Arg{A: 2, B: 1}, &Arg{A: 3, B: 1}},
+		func() interface{} { return new(int) },
+		cliSession.ScatterOptions{Mode: cliSession.GatherQuorum, Quorum: 2, Concurrency: 1},
+	)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	t.Logf("%v %v %v", pullCmds[0].Rerror(), pullCmds[1].Rerror(), pullCmds[2].Rerror())
+	cli.Close()
+}
+
+// A the handlers that require the login.
+type A struct {
+	tp.PullCtx
+}
+
+type LoginArg struct {
+	Name string
+}
+
+var authLogins int32
+
+func (a *A) Login(arg *LoginArg) (string, *tp.Rerror) {
+	token := fmt.Sprintf("%s-%d", arg.Name, atomic.AddInt32(&authLogins, 1))
+	a.Session().Swap().Store("token", token)
+	return token, nil
+}
+
+func (a *A) Whoami(*struct{}) (string, *tp.Rerror) {
+	token, ok := a.Session().Swap().Load("token")
+	if !ok {
+		return "", tp.NewRerror(401, "Unauthorized", "")
+	}
+	return token.(string), nil
+}
+
+func (a *A) Expire(*struct{}) (bool, *tp.Rerror) {
+	a.Session().Swap().Delete("token")
+	return true, nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9105,
+	})
+	srv.RoutePull(new(A))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9105",
+		1,
+		time.Second*5,
+	)
+	cli.SetAuthenticator(&cliSession.Authenticator{
+		Uri:          "/a/login",
+		Arg:          func() interface{} { return &LoginArg{Name: "tom"} },
+		ExpiredCodes: []int32{401},
+	})
+	var newSessions int32
+	cli.SetOnNewSession(func(sess tp.Session) *tp.Rerror {
+		token, _ := cliSession.Token(sess)
+		t.Logf("new session with token %v", token)
+		atomic.AddInt32(&newSessions, 1)
+		return nil
+	})
+
+	var token string
+	rerr := cli.Pull("/a/whoami", nil, &token).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if token != "tom-1" {
+		t.Fatalf("expect tom-1, but get %s", token)
+	}
+	var ok bool
+	cli.Pull("/a/expire", nil, &ok)
+	rerr = cli.Pull("/a/whoami", nil, &token).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if token != "tom-2" {
+		t.Fatalf("expect re-authenticated tom-2, but get %s", token)
+	}
+	// the async pull is re-sent too
+	cli.Pull("/a/expire", nil, &ok)
+	pullCmdChan := make(chan tp.PullCmd, 1)
+	cli.AsyncPull("/a/whoami", nil, &token, pullCmdChan)
+	if rerr = (<-pullCmdChan).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if token != "tom-3" {
+		t.Fatalf("expect re-authenticated tom-3, but get %s", token)
+	}
+	if n := atomic.LoadInt32(&newSessions); n != 1 {
+		t.Fatalf("expect 1 new session, but get %d", n)
+	}
+	cli.Close()
+}
+
+// C the read-mostly handlers.
+type C struct {
+	tp.PullCtx
+}
+
+var cacheCalls int32
+
+func (c *C) Config(arg *Arg) (int, *tp.Rerror) {
+	atomic.AddInt32(&cacheCalls, 1)
+	time.Sleep(time.Millisecond * 200)
+	return arg.A + arg.B, nil
+}
+
+func (c *C) Nostore(arg *Arg) (int, *tp.Rerror) {
+	atomic.AddInt32(&cacheCalls, 1)
+	c.SetMeta(cliSession.CACHE_CONTROL_META_KEY, "no-store")
+	return arg.A + arg.B, nil
+}
+
+func TestCache(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9106,
+	})
+	srv.RoutePull(new(C))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9106",
+		100,
+		time.Second*5,
+	)
+	cli.SetCache(&cliSession.CacheConfig{
+		TTLs: map[string]time.Duration{
+			"/c/config":  time.Millisecond * 500,
+			"/c/nostore": time.Minute,
+		},
+		MaxEntries: 2,
+	})
+
+	// the concurrent identical pulls share one round trip
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result int
+			rerr := cli.Pull("/c/config", &Arg{A: 1, B: 2}, &result).Rerror()
+			if rerr != nil || result != 3 {
+				t.Errorf("expect 3, but get %d, %v", result, rerr)
+			}
+		}()
+	}
+	wg.Wait()
+	var result int
+	cli.Pull("/c/config", &Arg{A: 1, B: 2}, &result)
+	if n := atomic.LoadInt32(&cacheCalls); n != 1 {
+		t.Fatalf("expect 1 call, but get %d", n)
+	}
+
+	// the expired reply and the different arg are pulled again
+	time.Sleep(time.Millisecond * 600)
+	cli.Pull("/c/config", &Arg{A: 1, B: 2}, &result)
+	cli.Pull("/c/config", &Arg{A: 2, B: 2}, &result)
+	if n := atomic.LoadInt32(&cacheCalls); n != 3 {
+		t.Fatalf("expect 3 calls, but get %d", n)
+	}
+
+	// the server disables the cache
+	cli.Pull("/c/nostore", &Arg{A: 1, B: 2}, &result)
+	cli.Pull("/c/nostore", &Arg{A: 1, B: 2}, &result)
+	if n := atomic.LoadInt32(&cacheCalls); n != 5 {
+		t.Fatalf("expect 5 calls, but get %d", n)
+	}
+	t.Logf("%+v", cli.DetailedStats().Cache)
+	cli.Close()
+}
+
+// R the audit handlers.
+type R struct {
+	tp.PushCtx
+}
+
+var reliableReceived, reliableFailed int32
+
+func (r *R) Audit(arg *Arg) *tp.Rerror {
+	// the first handling of the 3rd push fails, it is re-sent
+	if arg.A == 2 && atomic.AddInt32(&reliableFailed, 1) == 1 {
+		return tp.NewRerror(500, "Audit Failed", "")
+	}
+	atomic.AddInt32(&reliableReceived, 1)
+	cliSession.AckReliablePush(r)
+	return nil
+}
+
+func TestReliablePush(t *testing.T) {
+	f, err := ioutil.TempFile("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	cfg := cliSession.ReliableConfig{
+		SpoolFile:  f.Name(),
+		AckTimeout: time.Millisecond * 500,
+	}
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}, cliSession.NewReliableAckPlugin()),
+		":9107",
+		100,
+		time.Second*5,
+	)
+
+	// the server is down, the pushes are spooled
+	pusher, err := cliSession.NewReliablePusher(cli, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = pusher.Push("/r/audit", &Arg{A: i, B: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	pusher.Close()
+
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9107,
+	}, cliSession.NewReliablePushPlugin(0))
+	srv.RoutePush(new(R))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	// the unacknowledged pushes are replayed
+	pusher, err = cliSession.NewReliablePusher(cli, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pusher.Pending(); n != 3 {
+		t.Fatalf("expect 3 pending pushes, but get %d", n)
+	}
+	for i := 0; i < 30 && pusher.Pending() > 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if n := pusher.Pending(); n != 0 {
+		t.Fatalf("expect all pushes acknowledged, but %d pending", n)
+	}
+	if n := atomic.LoadInt32(&reliableFailed); n != 2 {
+		t.Fatalf("expect the failed push re-sent once, but get %d handlings", n)
+	}
+
+	// the duplicate push is discarded
+	for i := 0; i < 2; i++ {
+		cli.Push("/r/audit", &Arg{A: 1, B: 1}, tp.WithSetMeta(cliSession.PUSH_ID_META_KEY, "dup"))
+	}
+	time.Sleep(time.Millisecond * 200)
+	if n := atomic.LoadInt32(&reliableReceived); n != 4 {
+		t.Fatalf("expect 4 received pushes, but get %d", n)
+	}
+	pusher.Close()
+	cli.Close()
+}
+
+func TestLimiter(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9108,
+	})
+	srv.RoutePull(new(P))
+	srv.RoutePull(new(S))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9108",
+		100,
+		time.Second*5,
+	)
+	cli.SetLimiter(&cliSession.LimiterConfig{
+		Global: &cliSession.RateLimit{Rate: 10, Burst: 1},
+		Uris: map[string]cliSession.RateLimit{
+			"/p/divide": {Rate: 1, Burst: 1, FailFast: true},
+		},
+		Inflight: &cliSession.ConcurrencyLimit{Max: 1, FailFast: true},
+	})
+	var left int64
+
+	// wait for the global tokens
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		rerr := cli.Pull("/s/sleep", &SleepArg{}, &left).Rerror()
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	if cost := time.Since(start); cost < time.Millisecond*350 {
+		t.Fatalf("expect about 400ms for 5 pulls, but get %v", cost)
+	}
+
+	// fail fast by the URI limit
+	var result int
+	cli.Pull("/p/divide", &Arg{A: 1, B: 1}, &result)
+	rerr := cli.Pull("/p/divide", &Arg{A: 1, B: 1}, &result).Rerror()
+	if rerr == nil || rerr.Code != cliSession.CodeRateLimited {
+		t.Fatalf("expect rate limited, but get %v", rerr)
+	}
+
+	// fail fast by the in-flight limit
+	time.Sleep(time.Millisecond * 100)
+	go cli.Pull("/s/sleep", &SleepArg{D: time.Millisecond * 500}, &left)
+	time.Sleep(time.Millisecond * 200)
+	rerr = cli.Pull("/s/sleep", &SleepArg{}, &left).Rerror()
+	if rerr == nil || rerr.Code != cliSession.CodeRateLimited {
+		t.Fatalf("expect in-flight limited, but get %v", rerr)
+	}
+	t.Logf("%+v", cli.DetailedStats().Limiter)
+	cli.Close()
+}
+
+var benchServerOnce sync.Once
+
+func benchPull(b *testing.B, cli *cliSession.CliSession) {
+	benchServerOnce.Do(func() {
+		srv := tp.NewPeer(tp.PeerConfig{
+			ListenPort: 9099,
+		})
+		srv.RoutePull(new(P))
+		go srv.ListenAndServe()
+		time.Sleep(time.Second)
+	})
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var result int
+		for pb.Next() {
+			if rerr := cli.Pull("/p/divide", &Arg{A: 10, B: 2}, &result).Rerror(); rerr != nil {
+				b.Fatal(rerr)
+			}
+		}
+	})
+	b.StopTimer()
+	b.Logf("sessions: %d, created: %d", cli.Stats().Worker, cli.Stats().Created)
+	cli.Close()
+}
+
+func BenchmarkWorkshopPull(b *testing.B) {
+	benchPull(b, cliSession.New(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9099",
+		100,
+		time.Second*5,
+	))
+}
+
+func BenchmarkMuxPull(b *testing.B) {
+	benchPull(b, cliSession.NewMux(
+		tp.NewPeer(tp.PeerConfig{}),
+		":9099",
+		100,
+		64,
+		time.Second*5,
+	))
+}
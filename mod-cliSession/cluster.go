@@ -0,0 +1,365 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// ClusterSession client session which is has a connection pool for each address,
+// and selects one of them for each call by the balancer.
+type ClusterSession struct {
+	peer                tp.Peer
+	balancer            Balancer
+	sessMaxQuota        int
+	sessMaxIdleDuration time.Duration
+	protoFunc           []socket.ProtoFunc
+	nodes               []*Node
+	nodeSetup           func(*CliSession)
+	resolver            Resolver
+	hedger              *hedger
+	closed              bool
+	mu                  sync.RWMutex
+}
+
+var rerrNoAvailableNode = tp.NewRerror(tp.CodeDialFailed, "Dial Failed", "no available address")
+
+// NewCluster creates a client session which is has a connection pool for each address.
+// Note: If balancer is nil, use the round-robin balancer.
+func NewCluster(peer tp.Peer, addrs []string, balancer Balancer, sessMaxQuota int, sessMaxIdleDuration time.Duration, protoFunc ...socket.ProtoFunc) *ClusterSession {
+	if balancer == nil {
+		balancer = NewRoundRobinBalancer()
+	}
+	c := &ClusterSession{
+		peer:                peer,
+		balancer:            balancer,
+		sessMaxQuota:        sessMaxQuota,
+		sessMaxIdleDuration: sessMaxIdleDuration,
+		protoFunc:           protoFunc,
+	}
+	for _, addr := range addrs {
+		if c.getNode(addr) != nil {
+			continue
+		}
+		c.nodes = append(c.nodes, c.newNode(addr))
+	}
+	return c
+}
+
+// NewClusterWithResolver creates a client session which is has a connection pool for each address,
+// and the addresses are updated by the resolver.
+// Note: If balancer is nil, use the round-robin balancer.
+func NewClusterWithResolver(peer tp.Peer, resolver Resolver, balancer Balancer, sessMaxQuota int, sessMaxIdleDuration time.Duration, protoFunc ...socket.ProtoFunc) (*ClusterSession, error) {
+	addrs, err := resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	c := NewCluster(peer, addrs, balancer, sessMaxQuota, sessMaxIdleDuration, protoFunc...)
+	c.resolver = resolver
+	go c.watch()
+	return c, nil
+}
+
+func (c *ClusterSession) watch() {
+	for addrs := range c.resolver.Watch() {
+		c.updateAddrs(addrs)
+	}
+}
+
+// updateAddrs starts dialing the newly added addresses,
+// and drains the sessions to the removed addresses.
+func (c *ClusterSession) updateAddrs(addrs []string) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	var (
+		nodes   = make([]*Node, 0, len(addrs))
+		added   []*Node
+		removed []*Node
+		keep    = make(map[string]bool, len(addrs))
+	)
+	for _, addr := range addrs {
+		if keep[addr] {
+			continue
+		}
+		keep[addr] = true
+		n := c.getNode(addr)
+		if n == nil {
+			n = c.newNode(addr)
+			added = append(added, n)
+		}
+		nodes = append(nodes, n)
+	}
+	for _, n := range c.nodes {
+		if !keep[n.addr] {
+			removed = append(removed, n)
+		}
+	}
+	c.nodes = nodes
+	c.mu.Unlock()
+
+	for _, n := range added {
+		tp.Infof("cliSession: cluster add address: %s", n.addr)
+		go n.sess.warmUp()
+	}
+	for _, n := range removed {
+		tp.Infof("cliSession: cluster remove address: %s", n.addr)
+		go n.drain()
+	}
+}
+
+// SetNodeSetup sets the function to configure the session pool of each address,
+// it is applied to the current addresses and the ones added later.
+func (c *ClusterSession) SetNodeSetup(fn func(*CliSession)) {
+	c.mu.Lock()
+	c.nodeSetup = fn
+	nodes := c.nodes
+	c.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	for _, n := range nodes {
+		fn(n.sess)
+	}
+}
+
+// newNode creates a node, should be called with c.mu locked or during initialization.
+func (c *ClusterSession) newNode(addr string) *Node {
+	sess := New(c.peer, addr, c.sessMaxQuota, c.sessMaxIdleDuration, c.protoFunc...)
+	if c.nodeSetup != nil {
+		c.nodeSetup(sess)
+	}
+	return &Node{
+		addr: addr,
+		sess: sess,
+	}
+}
+
+func (c *ClusterSession) getNode(addr string) *Node {
+	for _, n := range c.nodes {
+		if n.addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses.
+func (c *ClusterSession) Addrs() []string {
+	nodes := c.Nodes()
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.addr
+	}
+	return addrs
+}
+
+// Nodes returns the nodes.
+func (c *ClusterSession) Nodes() []*Node {
+	c.mu.RLock()
+	nodes := c.nodes
+	c.mu.RUnlock()
+	return nodes
+}
+
+// Peer returns the peer.
+func (c *ClusterSession) Peer() tp.Peer {
+	return c.peer
+}
+
+// Balancer returns the balancer.
+func (c *ClusterSession) Balancer() Balancer {
+	return c.balancer
+}
+
+// Close stops the resolver and closes the session pools of all the addresses.
+func (c *ClusterSession) Close() {
+	for _, n := range c.stop() {
+		n.sess.Close()
+	}
+}
+
+// stop stops the resolver and the address updates, and returns the current nodes.
+func (c *ClusterSession) stop() []*Node {
+	c.mu.Lock()
+	c.closed = true
+	nodes := c.nodes
+	c.mu.Unlock()
+	if c.resolver != nil {
+		c.resolver.Close()
+	}
+	return nodes
+}
+
+// Stats returns the current session pool stats of each address.
+func (c *ClusterSession) Stats() map[string]Stats {
+	nodes := c.Nodes()
+	stats := make(map[string]Stats, len(nodes))
+	for _, n := range nodes {
+		stats[n.addr] = n.sess.DetailedStats()
+	}
+	return stats
+}
+
+// selectNode selects a node and begins a call on it, which must be ended by n.end().
+func (c *ClusterSession) selectNode(uri string, setting []socket.PacketSetting) (*Node, *tp.Rerror) {
+	n := c.selectFrom(c.Nodes(), uri, setting)
+	if n == nil {
+		return nil, rerrNoAvailableNode
+	}
+	return n, nil
+}
+
+// selectFrom selects one of the nodes and begins a call on it, skipping the nodes being drained.
+// It returns nil if there is no available node.
+func (c *ClusterSession) selectFrom(nodes []*Node, uri string, setting []socket.PacketSetting) *Node {
+	for len(nodes) > 0 {
+		n := c.balancer.Select(nodes, uri, setting...)
+		if n == nil {
+			return nil
+		}
+		if n.begin() {
+			return n
+		}
+		nodes = excludeNode(nodes, n)
+	}
+	return nil
+}
+
+// excludeNode returns a copy of the nodes without the n.
+func excludeNode(nodes []*Node, n *Node) []*Node {
+	others := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node != n {
+			others = append(others, node)
+		}
+	}
+	return others
+}
+
+// AsyncPull sends a packet and receives reply asynchronously.
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name.
+func (c *ClusterSession) AsyncPull(
+	uri string,
+	arg interface{},
+	result interface{},
+	pullCmdChan chan<- tp.PullCmd,
+	setting ...socket.PacketSetting,
+) tp.PullCmd {
+	n, rerr := c.selectNode(uri, setting)
+	if rerr != nil {
+		return fakeAsyncPull(uri, arg, result, pullCmdChan, rerr)
+	}
+	pullCmd := n.sess.AsyncPull(uri, arg, result, pullCmdChan, setting...)
+	if !tp.Go(func() {
+		<-pullCmd.Done()
+		n.end()
+	}) {
+		n.end()
+	}
+	return pullCmd
+}
+
+// Pull sends a packet and receives reply.
+// Note:
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
+func (c *ClusterSession) Pull(uri string, arg interface{}, result interface{}, setting ...socket.PacketSetting) tp.PullCmd {
+	return c.PullContext(context.Background(), uri, arg, result, setting...)
+}
+
+// PullContext sends a packet and receives reply, it returns when the ctx is done.
+// Note:
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure;
+// If the hedging policy is set, the slow pull is hedged with another address.
+func (c *ClusterSession) PullContext(ctx context.Context, uri string, arg interface{}, result interface{}, setting ...socket.PacketSetting) tp.PullCmd {
+	n, rerr := c.selectNode(uri, setting)
+	if rerr != nil {
+		return tp.NewFakePullCmd(uri, arg, result, rerr)
+	}
+	// the call has been begun on the node selected.
+	pullOn := func(n *Node) hedgeCall {
+		return func(ctx context.Context, result interface{}) (tp.PullCmd, bool) {
+			defer n.end()
+			return n.sess.PullContext(ctx, uri, arg, result, setting...), true
+		}
+	}
+	backup := func(ctx context.Context, result interface{}) (tp.PullCmd, bool) {
+		other, rerr := c.selectOtherNode(n, uri, setting)
+		if rerr != nil {
+			return tp.NewFakePullCmd(uri, arg, result, rerr), false
+		}
+		return pullOn(other)(ctx, result)
+	}
+	pullCmd, _ := c.getHedger().do(ctx, uri, result, pullOn(n), backup)
+	return pullCmd
+}
+
+// selectOtherNode selects a node other than the n and begins a call on it,
+// if there is no other node, select the n.
+func (c *ClusterSession) selectOtherNode(n *Node, uri string, setting []socket.PacketSetting) (*Node, *tp.Rerror) {
+	if other := c.selectFrom(excludeNode(c.Nodes(), n), uri, setting); other != nil {
+		return other, nil
+	}
+	if n.begin() {
+		return n, nil
+	}
+	return nil, rerrNoAvailableNode
+}
+
+// SetHedgePolicy sets the hedging policy of the pull.
+// Note: If policy is nil, do not hedge.
+func (c *ClusterSession) SetHedgePolicy(policy *HedgePolicy) {
+	var h *hedger
+	if policy != nil {
+		h = newHedger(*policy)
+	}
+	c.mu.Lock()
+	c.hedger = h
+	c.mu.Unlock()
+}
+
+func (c *ClusterSession) getHedger() *hedger {
+	c.mu.RLock()
+	h := c.hedger
+	c.mu.RUnlock()
+	return h
+}
+
+// HedgeStats returns the hedging stats, nil if the hedging policy is not set.
+func (c *ClusterSession) HedgeStats() *HedgeStats {
+	return c.getHedger().getStats()
+}
+
+// Push sends a packet, but do not receives reply.
+// Note:
+// If the arg is []byte or *[]byte type, it can automatically fill in the body codec name;
+// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
+func (c *ClusterSession) Push(uri string, arg interface{}, setting ...socket.PacketSetting) *tp.Rerror {
+	n, rerr := c.selectNode(uri, setting)
+	if rerr != nil {
+		return rerr
+	}
+	defer n.end()
+	return n.sess.Push(uri, arg, setting...)
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+const (
+	// CodeCanceled the Rerror code returned when the context is canceled.
+	CodeCanceled int32 = 1499
+	// CodeDeadlineExceeded the Rerror code returned when the context deadline is exceeded.
+	CodeDeadlineExceeded int32 = 1504
+)
+
+// TIMEOUT_META_KEY the remaining time of the caller's deadline, in milliseconds.
+const TIMEOUT_META_KEY = "X-Timeout"
+
+// toContextRerror converts the error of the done context to *tp.Rerror.
+func toContextRerror(err error) *tp.Rerror {
+	if err == context.DeadlineExceeded {
+		return tp.NewRerror(CodeDeadlineExceeded, "Deadline Exceeded", err.Error())
+	}
+	return tp.NewRerror(CodeCanceled, "Canceled", err.Error())
+}
+
+// hireContext hires a healthy session from the pool, it gives up waiting when the ctx is done.
+func (c *CliSession) hireContext(ctx context.Context) (tp.Session, *tp.Rerror) {
+	if ctx.Done() == nil {
+		return c.hire()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, toContextRerror(err)
+	}
+	type hired struct {
+		sess tp.Session
+		rerr *tp.Rerror
+	}
+	ch := make(chan hired, 1)
+	go func() {
+		sess, rerr := c.hire()
+		ch <- hired{sess, rerr}
+	}()
+	select {
+	case h := <-ch:
+		return h.sess, h.rerr
+	case <-ctx.Done():
+		// give the late session back to the pool.
+		go func() {
+			if h := <-ch; h.rerr == nil {
+				c.fire(h.sess)
+			}
+		}()
+		return nil, toContextRerror(ctx.Err())
+	}
+}
+
+// withTimeoutMeta appends the setting of the TIMEOUT_META_KEY metadata, if the ctx has a deadline.
+func withTimeoutMeta(ctx context.Context, setting []socket.PacketSetting) ([]socket.PacketSetting, *tp.Rerror) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return setting, nil
+	}
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return setting, toContextRerror(context.DeadlineExceeded)
+	}
+	ms := strconv.FormatInt(int64((timeout+time.Millisecond-1)/time.Millisecond), 10)
+	setting = append(setting[:len(setting):len(setting)], func(packet *socket.Packet) {
+		packet.Meta().Set(TIMEOUT_META_KEY, ms)
+	})
+	return setting, nil
+}
+
+// NewDeadlinePlugin creates a server-side plugin that reads the TIMEOUT_META_KEY metadata,
+// the handlers can get the caller's deadline by Deadline.
+func NewDeadlinePlugin() tp.Plugin {
+	return new(deadlinePlugin)
+}
+
+type deadlinePlugin struct{}
+
+var (
+	_ tp.PostReadPullHeaderPlugin = new(deadlinePlugin)
+	_ tp.PostReadPushHeaderPlugin = new(deadlinePlugin)
+)
+
+const deadlineSwapKey swapKey = "deadline"
+
+// cliSessionSwapKey the key of the CliSession that dialed the session.
+const cliSessionSwapKey swapKey = "cliSession"
+
+type swapKey string
+
+func (*deadlinePlugin) Name() string {
+	return "deadline"
+}
+
+func (*deadlinePlugin) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	b := ctx.PeekMeta(TIMEOUT_META_KEY)
+	if len(b) == 0 {
+		return nil
+	}
+	ms, err := strconv.ParseInt(goutil.BytesToString(b), 10, 64)
+	if err != nil || ms <= 0 {
+		return tp.NewRerror(tp.CodeBadPacket, "Invalid Timeout", goutil.BytesToString(b))
+	}
+	ctx.Swap().Store(deadlineSwapKey, time.Now().Add(time.Duration(ms)*time.Millisecond))
+	return nil
+}
+
+func (d *deadlinePlugin) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	return d.PostReadPullHeader(ctx)
+}
+
+// Deadline returns the caller's deadline that is set by NewDeadlinePlugin.
+func Deadline(ctx tp.PreCtx) (deadline time.Time, ok bool) {
+	v, ok := ctx.Swap().Load(deadlineSwapKey)
+	if !ok {
+		return
+	}
+	return v.(time.Time), true
+}
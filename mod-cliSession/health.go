@@ -0,0 +1,186 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/goutil/pool"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// DefaultProbeUri the default URI of the health probe,
+// it is compatible with the heartbeat plugin(plugin-heartbeat).
+const DefaultProbeUri = "/heartbeat"
+
+// maxHireTimes the maximum number of times to hire a session in one call.
+const maxHireTimes = 3
+
+var rerrNoHealthySession = tp.NewRerror(tp.CodeConnClosed, "Connection Closed", "no healthy session in the pool")
+
+// hire hires a healthy session from the pool,
+// the dead sessions are evicted and redialed.
+func (c *CliSession) hire() (tp.Session, *tp.Rerror) {
+	for i := 0; i < maxHireTimes; i++ {
+		sess, err := c.pool.hire()
+		if err != nil {
+			return nil, toHireRerror(err)
+		}
+		if sess.Health() {
+			return sess, nil
+		}
+		c.evict(sess)
+	}
+	return nil, rerrNoHealthySession
+}
+
+var rerrPoolClosed = tp.NewRerror(tp.CodeConnClosed, "Connection Closed", "the session pool is closed")
+
+// toHireRerror converts the error of hiring to *tp.Rerror.
+func toHireRerror(err error) *tp.Rerror {
+	if err == pool.ErrWorkshopClosed {
+		return rerrPoolClosed
+	}
+	return tp.NewRerror(tp.CodeDialFailed, "Dial Failed", err.Error())
+}
+
+// warmUp dials a session in advance.
+func (c *CliSession) warmUp() {
+	sess, rerr := c.hire()
+	if rerr != nil {
+		tp.Warnf("cliSession: warm up %s error: %v", c.addr, rerr)
+		return
+	}
+	c.fire(sess)
+}
+
+// fire returns the session to the pool.
+func (c *CliSession) fire(sess tp.Session) {
+	if probe := c.getProbe(); probe != nil {
+		probe.touch(sess)
+	}
+	c.pool.fire(sess)
+}
+
+// evict closes the dead session and returns it to the pool,
+// the pool discards the unhealthy session when it is fired.
+func (c *CliSession) evict(sess tp.Session) {
+	sess.Close()
+	c.pool.fire(sess)
+	atomic.AddUint64(&c.evicted, 1)
+	atomic.AddInt64(&c.pendingRedial, 1)
+	tp.Debugf("cliSession: evict dead session: addr: %s, id: %s", c.addr, sess.Id())
+}
+
+// SetHealthProbe starts pulling uri on the sessions that have been idle for the interval,
+// and closes those who fail, so that they are evicted before being handed out.
+// Note:
+// If uri is empty, use DefaultProbeUri;
+// If interval<=0, stop the health probe.
+func (c *CliSession) SetHealthProbe(uri string, interval time.Duration) {
+	if len(uri) == 0 {
+		uri = DefaultProbeUri
+	}
+	var probe *healthProbe
+	if interval > 0 {
+		probe = &healthProbe{
+			uri:      uri,
+			interval: interval,
+			lastUsed: make(map[tp.Session]time.Time),
+			closeCh:  make(chan struct{}),
+		}
+	}
+	c.optMu.Lock()
+	old := c.probe
+	c.probe = probe
+	c.optMu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+	if probe != nil {
+		go probe.run()
+	}
+}
+
+func (c *CliSession) getProbe() *healthProbe {
+	c.optMu.RLock()
+	probe := c.probe
+	c.optMu.RUnlock()
+	return probe
+}
+
+type healthProbe struct {
+	uri      string
+	interval time.Duration
+	lastUsed map[tp.Session]time.Time
+	mu       sync.Mutex
+	closeCh  chan struct{}
+	once     sync.Once
+}
+
+func (h *healthProbe) touch(sess tp.Session) {
+	h.mu.Lock()
+	h.lastUsed[sess] = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *healthProbe) stop() {
+	h.once.Do(func() {
+		close(h.closeCh)
+	})
+}
+
+func (h *healthProbe) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.closeCh:
+			return
+		case <-ticker.C:
+			h.probeIdle()
+		}
+	}
+}
+
+func (h *healthProbe) probeIdle() {
+	var idle []tp.Session
+	deadline := time.Now().Add(-h.interval)
+	h.mu.Lock()
+	for sess, last := range h.lastUsed {
+		if !sess.Health() {
+			delete(h.lastUsed, sess)
+			continue
+		}
+		if last.Before(deadline) {
+			idle = append(idle, sess)
+			h.lastUsed[sess] = time.Now()
+		}
+	}
+	h.mu.Unlock()
+	for _, sess := range idle {
+		sess := sess
+		tp.Go(func() {
+			rerr := sess.Pull(h.uri, nil, nil).Rerror()
+			// CodeNotFound means the connection is alive, but the peer has no probe handler.
+			if rerr != nil && rerr.Code != tp.CodeNotFound {
+				tp.Debugf("cliSession: health probe failed: id: %s, rerror: %v", sess.Id(), rerr)
+				sess.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// HedgePolicy the hedging policy of the read-only pulls.
+// If the reply does not arrive in time, a duplicate pull is sent on another session or address,
+// and whichever reply arrives first is returned.
+type HedgePolicy struct {
+	// Uris the read-only URI paths that are allowed to be hedged.
+	Uris []string
+	// Delay sends the duplicate pull after the delay,
+	// if 0, use the observed P95 latency of the URI.
+	Delay time.Duration
+	// MinSamples the minimum number of the observed latencies before using the P95 latency, default 20.
+	MinSamples int
+	// BudgetPercent caps the duplicate pulls to the percent of all the hedgeable pulls, default 10.
+	BudgetPercent float64
+}
+
+// HedgeStats the hedging stats.
+type HedgeStats struct {
+	// Hedged the number of the duplicate pulls sent.
+	Hedged uint64
+	// Won the number of the duplicate pulls that returned first.
+	Won uint64
+	// Throttled the number of the duplicate pulls that were not sent for lack of budget.
+	Throttled uint64
+}
+
+const (
+	hedgeMaxBudget       = 10
+	hedgeLatencyPeriod   = time.Minute
+	hedgeLatencyQuantile = 0.95
+)
+
+type hedger struct {
+	delay      time.Duration
+	minSamples uint64
+	ratio      float64
+	uris       map[string]bool
+	latency    map[string]*rotatingHistogram
+	tokens     float64
+	stats      HedgeStats
+	mu         sync.Mutex
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	if policy.MinSamples <= 0 {
+		policy.MinSamples = 20
+	}
+	if policy.BudgetPercent <= 0 {
+		policy.BudgetPercent = 10
+	}
+	h := &hedger{
+		delay:      policy.Delay,
+		minSamples: uint64(policy.MinSamples),
+		ratio:      policy.BudgetPercent / 100,
+		uris:       make(map[string]bool, len(policy.Uris)),
+		latency:    make(map[string]*rotatingHistogram, len(policy.Uris)),
+	}
+	for _, uri := range policy.Uris {
+		h.uris[uri] = true
+		h.latency[uri] = newRotatingHistogram(hedgeLatencyPeriod)
+	}
+	return h
+}
+
+// SetHedgePolicy sets the hedging policy of the pull.
+// Note: If policy is nil, do not hedge.
+func (c *CliSession) SetHedgePolicy(policy *HedgePolicy) {
+	var h *hedger
+	if policy != nil {
+		h = newHedger(*policy)
+	}
+	c.optMu.Lock()
+	c.hedger = h
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getHedger() *hedger {
+	c.optMu.RLock()
+	h := c.hedger
+	c.optMu.RUnlock()
+	return h
+}
+
+// pullAttempt pulls once, it is hedged with another pooled session if the hedging policy applies.
+// The duplicate pull waits for the rate limits too, and avoids the session of the primary pull.
+func (c *CliSession) pullAttempt(ctx context.Context, uri string, arg interface{}, result interface{}, setting []socket.PacketSetting) (tp.PullCmd, bool) {
+	var primarySess atomic.Value
+	primary := func(ctx context.Context, result interface{}) (tp.PullCmd, bool) {
+		return c.pullOnce(ctx, uri, arg, result, setting, func(ctx context.Context) (tp.Session, *tp.Rerror) {
+			sess, rerr := c.hireContext(ctx)
+			if rerr == nil {
+				primarySess.Store(hiredSession{sess})
+			}
+			return sess, rerr
+		})
+	}
+	backup := func(ctx context.Context, result interface{}) (tp.PullCmd, bool) {
+		release, rerr := c.getLimiter().acquire(ctx, uri)
+		if rerr != nil {
+			return tp.NewFakePullCmd(uri, arg, result, rerr), false
+		}
+		defer release()
+		return c.pullOnce(ctx, uri, arg, result, setting, func(ctx context.Context) (tp.Session, *tp.Rerror) {
+			exclude, _ := primarySess.Load().(hiredSession)
+			return c.hireExcept(ctx, exclude.Session)
+		})
+	}
+	return c.getHedger().do(ctx, uri, result, primary, backup)
+}
+
+// hiredSession wraps the hired session to be stored in the atomic.Value.
+type hiredSession struct {
+	tp.Session
+}
+
+// hireExcept hires a healthy session other than the exclude, if the pool has no other one, hire the exclude.
+func (c *CliSession) hireExcept(ctx context.Context, exclude tp.Session) (tp.Session, *tp.Rerror) {
+	sess, rerr := c.hireContext(ctx)
+	if rerr != nil || exclude == nil || sess != exclude {
+		return sess, rerr
+	}
+	// hire again while holding the exclude, so that the pool hands out or dials another one.
+	other, rerr := c.hireContext(ctx)
+	c.fire(sess)
+	return other, rerr
+}
+
+type (
+	hedgeCall   func(ctx context.Context, result interface{}) (pullCmd tp.PullCmd, sent bool)
+	hedgeResult struct {
+		pullCmd tp.PullCmd
+		sent    bool
+		result  interface{}
+		start   time.Time
+		hedged  bool
+	}
+)
+
+// do calls primary, and calls backup if the reply does not arrive in time.
+// The reply that arrives first is copied to the result, and the slower one is canceled.
+func (h *hedger) do(ctx context.Context, uri string, result interface{}, primary, backup hedgeCall) (tp.PullCmd, bool) {
+	path := uriPath(uri)
+	if h == nil || !h.uris[path] || !canCloneResult(result) {
+		return primary(ctx, result)
+	}
+	delay, ok := h.getDelay(path)
+	if !ok {
+		start := time.Now()
+		pullCmd, sent := primary(ctx, result)
+		h.observe(path, pullCmd, start)
+		return pullCmd, sent
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan hedgeResult, 2)
+	launch := func(call hedgeCall, hedged bool) {
+		r := hedgeResult{
+			result: cloneResult(result),
+			start:  time.Now(),
+			hedged: hedged,
+		}
+		go func() {
+			r.pullCmd, r.sent = call(ctx, r.result)
+			ch <- r
+		}()
+	}
+	launch(primary, false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var (
+		pending = 1
+		sent    bool
+		r       hedgeResult
+	)
+	for {
+		select {
+		case <-timer.C:
+			if h.takeBudget() {
+				launch(backup, true)
+				pending++
+			}
+			continue
+		case r = <-ch:
+		}
+		pending--
+		sent = sent || r.sent
+		if r.pullCmd.Rerror() == nil || pending == 0 {
+			break
+		}
+	}
+	h.observe(path, r.pullCmd, r.start)
+	if r.hedged && r.pullCmd.Rerror() == nil {
+		h.mu.Lock()
+		h.stats.Won++
+		h.mu.Unlock()
+	}
+	copyResult(result, r.result)
+	return hedgedPullCmd{PullCmd: r.pullCmd, result: result}, sent || pending > 0
+}
+
+// hedgedPullCmd the PullCmd of the hedged pull, whose reply has been copied to the caller's result.
+type hedgedPullCmd struct {
+	tp.PullCmd
+	result interface{}
+}
+
+// Result returns the pull result.
+// Notes: Inside, <-Done() is automatically called and blocked, until the pull is completed!
+func (p hedgedPullCmd) Result() (interface{}, *tp.Rerror) {
+	_, rerr := p.PullCmd.Result()
+	return p.result, rerr
+}
+
+// getDelay returns the delay of the duplicate pull, ok is false if the latency is unknown.
+func (h *hedger) getDelay(path string) (time.Duration, bool) {
+	h.mu.Lock()
+	h.tokens += h.ratio
+	if h.tokens > hedgeMaxBudget {
+		h.tokens = hedgeMaxBudget
+	}
+	h.mu.Unlock()
+	if h.delay > 0 {
+		return h.delay, true
+	}
+	d, n := h.latency[path].quantile(hedgeLatencyQuantile)
+	return d, n >= h.minSamples
+}
+
+func (h *hedger) takeBudget() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		h.stats.Throttled++
+		return false
+	}
+	h.tokens--
+	h.stats.Hedged++
+	return true
+}
+
+func (h *hedger) observe(path string, pullCmd tp.PullCmd, start time.Time) {
+	if pullCmd.Rerror() == nil {
+		h.latency[path].observe(time.Since(start))
+	}
+}
+
+func (h *hedger) getStats() *HedgeStats {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	stats := h.stats
+	h.mu.Unlock()
+	return &stats
+}
+
+// canCloneResult reports whether the result can be cloned for the duplicate pull.
+func canCloneResult(result interface{}) bool {
+	if result == nil {
+		return true
+	}
+	v := reflect.ValueOf(result)
+	return v.Kind() == reflect.Ptr && !v.IsNil()
+}
+
+// cloneResult returns a new zero result of the same type.
+func cloneResult(result interface{}) interface{} {
+	if result == nil {
+		return nil
+	}
+	return reflect.New(reflect.TypeOf(result).Elem()).Interface()
+}
+
+// copyResult copies src to dst, both are the pointers of the same type.
+func copyResult(dst, src interface{}) {
+	if dst == nil {
+		return
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// histogramBounds the upper bounds of the latency buckets,
+// growing by a factor of sqrt(2) from 100µs to about 100s.
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 41)
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(100*time.Microsecond) * math.Pow(math.Sqrt2, float64(i)))
+	}
+	return bounds
+}()
+
+// histogram the latency histogram, it is not concurrent safe.
+type histogram struct {
+	// the last one is the +Inf bucket
+	counts [42]uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// quantile returns the estimated q-quantile(0<q<=1) by linear interpolation in the bucket.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cum float64
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		if cum+float64(n) < rank {
+			cum += float64(n)
+			continue
+		}
+		if i == len(histogramBounds) {
+			return histogramBounds[i-1]
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = histogramBounds[i-1]
+		}
+		upper := histogramBounds[i]
+		return lower + time.Duration(float64(upper-lower)*(rank-cum)/float64(n))
+	}
+	return histogramBounds[len(histogramBounds)-1]
+}
+
+// rotatingHistogram the concurrent safe histogram of the recent observations,
+// which are kept for one to two periods.
+type rotatingHistogram struct {
+	period   time.Duration
+	current  histogram
+	previous histogram
+	rotated  time.Time
+	mu       sync.Mutex
+}
+
+func newRotatingHistogram(period time.Duration) *rotatingHistogram {
+	return &rotatingHistogram{
+		period:  period,
+		rotated: time.Now(),
+	}
+}
+
+func (r *rotatingHistogram) rotateLocked() {
+	now := time.Now()
+	if now.Sub(r.rotated) < r.period {
+		return
+	}
+	if now.Sub(r.rotated) < r.period*2 {
+		r.previous = r.current
+	} else {
+		r.previous = histogram{}
+	}
+	r.current = histogram{}
+	r.rotated = now
+}
+
+func (r *rotatingHistogram) observe(d time.Duration) {
+	r.mu.Lock()
+	r.rotateLocked()
+	r.current.observe(d)
+	r.mu.Unlock()
+}
+
+// quantile returns the q-quantile and the number of the observations.
+func (r *rotatingHistogram) quantile(q float64) (time.Duration, uint64) {
+	r.mu.Lock()
+	r.rotateLocked()
+	h := r.previous
+	h.merge(&r.current)
+	r.mu.Unlock()
+	return h.quantile(q), h.count
+}
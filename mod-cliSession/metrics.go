@@ -0,0 +1,306 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// URIStats the metrics of the calls of one URI path.
+type URIStats struct {
+	// Calls the number of the pulls and pushes.
+	Calls uint64
+	// Errors the number of the failed calls, grouped by the Rerror code.
+	Errors map[int32]uint64
+	// P50, P90 and P99 the latency percentiles of the recent calls.
+	P50, P90, P99 time.Duration
+	// BytesSent the number of the bytes of the packets sent,
+	// it is counted only if the plugin of NewMetricsPlugin is registered to the peer.
+	BytesSent uint64
+	// BytesReceived the number of the bytes of the reply packets received,
+	// it is counted only if the plugin of NewMetricsPlugin is registered to the peer.
+	BytesReceived uint64
+	// the cumulative latency histogram
+	latency histogram
+}
+
+// recentLatencyPeriod the period of the recent latencies for the percentiles.
+const recentLatencyPeriod = time.Minute
+
+type (
+	metrics struct {
+		uris map[string]*uriMetrics
+		mu   sync.RWMutex
+	}
+	uriMetrics struct {
+		calls    uint64
+		errors   map[int32]uint64
+		latency  histogram
+		recent   *rotatingHistogram
+		sent     uint64
+		received uint64
+		mu       sync.Mutex
+	}
+)
+
+func newMetrics() *metrics {
+	return &metrics{
+		uris: make(map[string]*uriMetrics),
+	}
+}
+
+func (m *metrics) getURI(uri string) *uriMetrics {
+	path := uriPath(uri)
+	m.mu.RLock()
+	u := m.uris[path]
+	m.mu.RUnlock()
+	if u != nil {
+		return u
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u = m.uris[path]; u == nil {
+		u = &uriMetrics{
+			errors: make(map[int32]uint64),
+			recent: newRotatingHistogram(recentLatencyPeriod),
+		}
+		m.uris[path] = u
+	}
+	return u
+}
+
+// observe records a call of the uri.
+func (m *metrics) observe(uri string, cost time.Duration, rerr *tp.Rerror) {
+	u := m.getURI(uri)
+	u.recent.observe(cost)
+	u.mu.Lock()
+	u.calls++
+	if rerr != nil {
+		u.errors[rerr.Code]++
+	}
+	u.latency.observe(cost)
+	u.mu.Unlock()
+}
+
+func (m *metrics) addSent(uri string, n uint32) {
+	atomic.AddUint64(&m.getURI(uri).sent, uint64(n))
+}
+
+func (m *metrics) addReceived(uri string, n uint32) {
+	atomic.AddUint64(&m.getURI(uri).received, uint64(n))
+}
+
+// snapshot returns the metrics of all the URI paths.
+func (m *metrics) snapshot() map[string]URIStats {
+	m.mu.RLock()
+	uris := make(map[string]*uriMetrics, len(m.uris))
+	for path, u := range m.uris {
+		uris[path] = u
+	}
+	m.mu.RUnlock()
+	r := make(map[string]URIStats, len(uris))
+	for path, u := range uris {
+		recent := u.recent
+		u.mu.Lock()
+		s := URIStats{
+			Calls:         u.calls,
+			Errors:        make(map[int32]uint64, len(u.errors)),
+			BytesSent:     atomic.LoadUint64(&u.sent),
+			BytesReceived: atomic.LoadUint64(&u.received),
+			latency:       u.latency,
+		}
+		for code, n := range u.errors {
+			s.Errors[code] = n
+		}
+		u.mu.Unlock()
+		s.P50, _ = recent.quantile(0.5)
+		s.P90, _ = recent.quantile(0.9)
+		s.P99, _ = recent.quantile(0.99)
+		r[path] = s
+	}
+	return r
+}
+
+// NewMetricsPlugin creates a client-side plugin that counts the bytes sent and received by the CliSession.
+// Note: It should be registered to the peer of the CliSession.
+func NewMetricsPlugin() tp.Plugin {
+	return new(metricsPlugin)
+}
+
+type metricsPlugin struct{}
+
+var (
+	_ tp.PostWritePullPlugin     = new(metricsPlugin)
+	_ tp.PostWritePushPlugin     = new(metricsPlugin)
+	_ tp.PostReadReplyBodyPlugin = new(metricsPlugin)
+)
+
+const metricsSwapKey swapKey = "metrics"
+
+func (*metricsPlugin) Name() string {
+	return "metrics"
+}
+
+func (*metricsPlugin) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	if m := sessionMetrics(ctx.Session()); m != nil {
+		m.addSent(ctx.Output().Uri(), ctx.Output().Size())
+	}
+	return nil
+}
+
+func (p *metricsPlugin) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	return p.PostWritePull(ctx)
+}
+
+func (*metricsPlugin) PostReadReplyBody(ctx tp.ReadCtx) *tp.Rerror {
+	if m := sessionMetrics(ctx.Session()); m != nil {
+		m.addReceived(ctx.Input().Uri(), ctx.Input().Size())
+	}
+	return nil
+}
+
+// sessionMetrics returns the metrics of the CliSession that dialed the sess.
+func sessionMetrics(sess tp.Session) *metrics {
+	v, ok := sess.Swap().Load(metricsSwapKey)
+	if !ok {
+		return nil
+	}
+	return v.(*metrics)
+}
+
+// MetricsHandler returns a http.Handler that writes the metrics in the Prometheus text format.
+func (c *CliSession) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, map[string]map[string]URIStats{c.addr: c.metrics.snapshot()})
+	})
+}
+
+// MetricsHandler returns a http.Handler that writes the metrics of all the addresses in the Prometheus text format.
+func (c *ClusterSession) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all := make(map[string]map[string]URIStats)
+		for _, n := range c.Nodes() {
+			all[n.addr] = n.sess.metrics.snapshot()
+		}
+		writeMetrics(w, all)
+	})
+}
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// writeMetrics writes the metrics grouped by the address and the URI path in the Prometheus text format.
+func writeMetrics(w http.ResponseWriter, all map[string]map[string]URIStats) {
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	type series struct {
+		labels string
+		stats  URIStats
+	}
+	var list []series
+	for _, addr := range sortedAddrs(all) {
+		for _, path := range sortedPaths(all[addr]) {
+			list = append(list, series{
+				labels: `addr="` + escapeLabel(addr) + `",uri="` + escapeLabel(path) + `"`,
+				stats:  all[addr][path],
+			})
+		}
+	}
+
+	writeHeader(bw, "cli_session_calls_total", "The number of the pulls and pushes.", "counter")
+	for _, s := range list {
+		fmt.Fprintf(bw, "cli_session_calls_total{%s} %d\n", s.labels, s.stats.Calls)
+	}
+	writeHeader(bw, "cli_session_errors_total", "The number of the failed calls by the Rerror code.", "counter")
+	for _, s := range list {
+		codes := make([]int, 0, len(s.stats.Errors))
+		for code := range s.stats.Errors {
+			codes = append(codes, int(code))
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(bw, "cli_session_errors_total{%s,code=\"%d\"} %d\n", s.labels, code, s.stats.Errors[int32(code)])
+		}
+	}
+	writeHeader(bw, "cli_session_latency_seconds", "The latency of the calls.", "histogram")
+	for _, s := range list {
+		var cum uint64
+		for i, bound := range histogramBounds {
+			cum += s.stats.latency.counts[i]
+			fmt.Fprintf(bw, "cli_session_latency_seconds_bucket{%s,le=\"%s\"} %d\n", s.labels, formatSeconds(bound), cum)
+		}
+		fmt.Fprintf(bw, "cli_session_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels, s.stats.latency.count)
+		fmt.Fprintf(bw, "cli_session_latency_seconds_sum{%s} %s\n", s.labels, formatSeconds(s.stats.latency.sum))
+		fmt.Fprintf(bw, "cli_session_latency_seconds_count{%s} %d\n", s.labels, s.stats.latency.count)
+	}
+	writeHeader(bw, "cli_session_recent_latency_seconds", "The latency percentiles of the recent calls.", "gauge")
+	for _, s := range list {
+		fmt.Fprintf(bw, "cli_session_recent_latency_seconds{%s,quantile=\"0.5\"} %s\n", s.labels, formatSeconds(s.stats.P50))
+		fmt.Fprintf(bw, "cli_session_recent_latency_seconds{%s,quantile=\"0.9\"} %s\n", s.labels, formatSeconds(s.stats.P90))
+		fmt.Fprintf(bw, "cli_session_recent_latency_seconds{%s,quantile=\"0.99\"} %s\n", s.labels, formatSeconds(s.stats.P99))
+	}
+	writeHeader(bw, "cli_session_sent_bytes_total", "The number of the bytes sent.", "counter")
+	for _, s := range list {
+		fmt.Fprintf(bw, "cli_session_sent_bytes_total{%s} %d\n", s.labels, s.stats.BytesSent)
+	}
+	writeHeader(bw, "cli_session_received_bytes_total", "The number of the bytes received.", "counter")
+	for _, s := range list {
+		fmt.Fprintf(bw, "cli_session_received_bytes_total{%s} %d\n", s.labels, s.stats.BytesReceived)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func sortedAddrs(all map[string]map[string]URIStats) []string {
+	addrs := make([]string, 0, len(all))
+	for addr := range all {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func sortedPaths(uris map[string]URIStats) []string {
+	paths := make([]string, 0, len(uris))
+	for path := range uris {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/goutil/pool"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// sessPool the session pool of CliSession.
+type sessPool interface {
+	hire() (tp.Session, error)
+	fire(tp.Session)
+	close()
+	stats() pool.WorkshopStats
+}
+
+// workshopPool the session pool based on *pool.Workshop,
+// the session is hired only while the packet is being sent.
+type workshopPool struct {
+	ws *pool.Workshop
+}
+
+func (w workshopPool) hire() (tp.Session, error) {
+	sess, err := w.ws.Hire()
+	if err != nil {
+		return nil, err
+	}
+	return sess.(tp.Session), nil
+}
+
+func (w workshopPool) fire(sess tp.Session) {
+	w.ws.Fire(sess)
+}
+
+func (w workshopPool) close() {
+	w.ws.Close()
+}
+
+func (w workshopPool) stats() pool.WorkshopStats {
+	return w.ws.Stats()
+}
+
+// NewMux creates a client session which is has a multiplexed connection pool.
+// Each session carries up to sessMaxInflight concurrent calls, which are held until replied,
+// and a new session is dialed only when all the existing sessions are at capacity.
+// When the sessMaxQuota sessions are all at capacity, the call waits until a slot is freed.
+func NewMux(peer tp.Peer, addr string, sessMaxQuota, sessMaxInflight int, sessMaxIdleDuration time.Duration, protoFunc ...socket.ProtoFunc) *CliSession {
+	c := newCliSession(peer, addr, protoFunc)
+	c.pool = newMuxPool(sessMaxQuota, sessMaxInflight, sessMaxIdleDuration, c.dial)
+	c.mux = true
+	return c
+}
+
+type (
+	// muxPool the multiplexed session pool.
+	muxPool struct {
+		dial            func() (tp.Session, error)
+		maxQuota        int
+		maxInflight     int
+		maxIdleDuration time.Duration
+		conns           []*muxConn
+		dialing         int
+		created         uint64
+		done            uint64
+		closed          bool
+		mu              sync.Mutex
+		cond            *sync.Cond
+		closeCh         chan struct{}
+	}
+	muxConn struct {
+		sess     tp.Session
+		inflight int
+		lastUsed time.Time
+	}
+)
+
+func newMuxPool(maxQuota, maxInflight int, maxIdleDuration time.Duration, dial func() (tp.Session, error)) *muxPool {
+	if maxQuota <= 0 {
+		maxQuota = 1
+	}
+	if maxInflight <= 0 {
+		maxInflight = 1
+	}
+	m := &muxPool{
+		dial:            dial,
+		maxQuota:        maxQuota,
+		maxInflight:     maxInflight,
+		maxIdleDuration: maxIdleDuration,
+		closeCh:         make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	if maxIdleDuration > 0 {
+		go m.gc()
+	}
+	return m
+}
+
+func (m *muxPool) hire() (tp.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if m.closed {
+			return nil, pool.ErrWorkshopClosed
+		}
+		m.pruneLocked()
+		var min *muxConn
+		for _, conn := range m.conns {
+			if min == nil || conn.inflight < min.inflight {
+				min = conn
+			}
+		}
+		// share the least loaded session that is not at capacity.
+		if min != nil && min.inflight < m.maxInflight {
+			return m.hireLocked(min), nil
+		}
+		// all the sessions are at capacity, dial a new one.
+		if len(m.conns)+m.dialing < m.maxQuota {
+			m.dialing++
+			m.mu.Unlock()
+			sess, err := m.dial()
+			m.mu.Lock()
+			m.dialing--
+			m.cond.Broadcast()
+			if err != nil {
+				return nil, err
+			}
+			m.created++
+			if m.closed {
+				sess.Close()
+				continue
+			}
+			conn := &muxConn{sess: sess}
+			m.conns = append(m.conns, conn)
+			return m.hireLocked(conn), nil
+		}
+		// the quota is used up, wait for a slot to be freed or a session to be dialed.
+		m.cond.Wait()
+	}
+}
+
+func (m *muxPool) hireLocked(conn *muxConn) tp.Session {
+	conn.inflight++
+	conn.lastUsed = time.Now()
+	return conn.sess
+}
+
+func (m *muxPool) fire(sess tp.Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, conn := range m.conns {
+		if conn.sess != sess {
+			continue
+		}
+		conn.inflight--
+		conn.lastUsed = time.Now()
+		m.done++
+		if !sess.Health() {
+			m.conns = append(m.conns[:i], m.conns[i+1:]...)
+		}
+		m.cond.Broadcast()
+		return
+	}
+}
+
+// pruneLocked removes the dead sessions.
+func (m *muxPool) pruneLocked() {
+	conns := m.conns[:0]
+	for _, conn := range m.conns {
+		if conn.sess.Health() {
+			conns = append(conns, conn)
+		}
+	}
+	for i := len(conns); i < len(m.conns); i++ {
+		m.conns[i] = nil
+	}
+	m.conns = conns
+}
+
+func (m *muxPool) gc() {
+	ticker := time.NewTicker(m.maxIdleDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-m.maxIdleDuration)
+		var idle []tp.Session
+		m.mu.Lock()
+		conns := m.conns[:0]
+		for _, conn := range m.conns {
+			if conn.inflight <= 0 && conn.lastUsed.Before(deadline) {
+				idle = append(idle, conn.sess)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+		m.conns = conns
+		if len(idle) > 0 {
+			m.cond.Broadcast()
+		}
+		m.mu.Unlock()
+		for _, sess := range idle {
+			sess.Close()
+		}
+	}
+}
+
+func (m *muxPool) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	conns := m.conns
+	m.conns = nil
+	close(m.closeCh)
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	for _, conn := range conns {
+		conn.sess.Close()
+	}
+}
+
+func (m *muxPool) stats() pool.WorkshopStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := pool.WorkshopStats{
+		Worker:  int32(len(m.conns)),
+		Created: m.created,
+		Done:    m.done,
+	}
+	for i, conn := range m.conns {
+		load := int32(conn.inflight)
+		if load <= 0 {
+			s.Idle++
+		}
+		s.Doing += load
+		if i == 0 || load > s.MaxLoad {
+			s.MaxLoad = load
+		}
+		if i == 0 || load < s.MinLoad {
+			s.MinLoad = load
+		}
+	}
+	return s
+}
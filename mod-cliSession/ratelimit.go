@@ -0,0 +1,305 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// CodeRateLimited the Rerror code returned when a fail-fast limit is exceeded.
+const CodeRateLimited int32 = 1429
+
+// RateLimit the token-bucket rate limit.
+type RateLimit struct {
+	// Rate the number of the tokens added per second, 0 or negative means no limit.
+	Rate float64
+	// Burst the size of the bucket, default max(1, Rate).
+	Burst int
+	// FailFast fails with CodeRateLimited instead of waiting for a token.
+	FailFast bool
+}
+
+// ConcurrencyLimit the limit of the concurrent in-flight calls.
+type ConcurrencyLimit struct {
+	// Max the maximum number of the in-flight calls.
+	Max int
+	// FailFast fails with CodeRateLimited instead of waiting for a call to finish.
+	FailFast bool
+}
+
+// LimiterConfig the client-side rate limits of the pulls and pushes.
+// Note: The waiting calls give up when the ctx is done, or at once if the token is not available before the ctx deadline.
+type LimiterConfig struct {
+	// Global the rate limit of all the calls, nil means no limit.
+	Global *RateLimit
+	// Uris the rate limits by the URI path, which are applied in addition to the global one.
+	Uris map[string]RateLimit
+	// Inflight the concurrency limit of all the calls, nil means no limit.
+	Inflight *ConcurrencyLimit
+}
+
+// LimiterStats the rate limiter stats.
+type LimiterStats struct {
+	// Global the global bucket stats, nil if there is no global limit.
+	Global *BucketStats
+	// Uris the bucket stats by the URI path.
+	Uris map[string]BucketStats
+	// Inflight the number of the in-flight calls.
+	Inflight int
+	// InflightUtilisation the ratio of the in-flight calls to the concurrency limit, 0 if there is no limit.
+	InflightUtilisation float64
+	// Waited the number of the calls that waited for a limit.
+	Waited uint64
+	// Rejected the number of the calls that failed with CodeRateLimited.
+	Rejected uint64
+}
+
+// BucketStats the token bucket stats.
+type BucketStats struct {
+	// Tokens the available tokens, negative if the tokens are reserved by the waiting calls.
+	Tokens float64
+	// Utilisation the ratio of the used tokens to the burst.
+	Utilisation float64
+}
+
+// SetLimiter sets the client-side rate limits of the pulls and pushes.
+// Note: If cfg is nil, do not limit.
+func (c *CliSession) SetLimiter(cfg *LimiterConfig) {
+	var l *limiter
+	if cfg != nil {
+		l = newLimiter(*cfg)
+	}
+	c.optMu.Lock()
+	c.limiter = l
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getLimiter() *limiter {
+	c.optMu.RLock()
+	l := c.limiter
+	c.optMu.RUnlock()
+	return l
+}
+
+type (
+	limiter struct {
+		global   *bucket
+		uris     map[string]*bucket
+		inflight chan struct{}
+		failFast bool
+		waited   uint64
+		rejected uint64
+	}
+	bucket struct {
+		rate     float64
+		burst    float64
+		failFast bool
+		tokens   float64
+		last     time.Time
+		mu       sync.Mutex
+	}
+)
+
+func newLimiter(cfg LimiterConfig) *limiter {
+	l := &limiter{
+		uris: make(map[string]*bucket, len(cfg.Uris)),
+	}
+	if cfg.Global != nil && cfg.Global.Rate > 0 {
+		l.global = newBucket(*cfg.Global)
+	}
+	for uri, limit := range cfg.Uris {
+		if limit.Rate > 0 {
+			l.uris[uri] = newBucket(limit)
+		}
+	}
+	if cfg.Inflight != nil && cfg.Inflight.Max > 0 {
+		l.inflight = make(chan struct{}, cfg.Inflight.Max)
+		l.failFast = cfg.Inflight.FailFast
+	}
+	return l
+}
+
+func newBucket(limit RateLimit) *bucket {
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, limit.Rate)
+	}
+	return &bucket{
+		rate:     limit.Rate,
+		burst:    burst,
+		failFast: limit.FailFast,
+		tokens:   burst,
+		last:     time.Now(),
+	}
+}
+
+var (
+	rerrRateLimited     = tp.NewRerror(CodeRateLimited, "Rate Limited", "the rate limit is exceeded")
+	rerrInflightLimited = tp.NewRerror(CodeRateLimited, "Rate Limited", "the in-flight limit is exceeded")
+)
+
+func noopRelease() {}
+
+// acquire takes a token from the global and the URI buckets and an in-flight slot,
+// the release must be called after the call is done.
+func (l *limiter) acquire(ctx context.Context, uri string) (release func(), rerr *tp.Rerror) {
+	if l == nil {
+		return noopRelease, nil
+	}
+	global, uriBucket := l.global, l.uris[uriPath(uri)]
+	if rerr = l.take(ctx, global); rerr != nil {
+		return nil, rerr
+	}
+	if rerr = l.take(ctx, uriBucket); rerr != nil {
+		global.cancel()
+		return nil, rerr
+	}
+	if l.inflight == nil {
+		return noopRelease, nil
+	}
+	release = func() { <-l.inflight }
+	select {
+	case l.inflight <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.failFast {
+		rerr = rerrInflightLimited
+		atomic.AddUint64(&l.rejected, 1)
+	} else {
+		atomic.AddUint64(&l.waited, 1)
+		select {
+		case l.inflight <- struct{}{}:
+			return release, nil
+		case <-ctx.Done():
+			rerr = toContextRerror(ctx.Err())
+		}
+	}
+	global.cancel()
+	uriBucket.cancel()
+	return nil, rerr
+}
+
+// take takes a token from the bucket, waiting for it if the bucket is not fail-fast.
+func (l *limiter) take(ctx context.Context, b *bucket) *tp.Rerror {
+	if b == nil {
+		return nil
+	}
+	wait, ok := b.reserve(ctx)
+	if !ok {
+		if b.failFast {
+			atomic.AddUint64(&l.rejected, 1)
+			return rerrRateLimited
+		}
+		return toContextRerror(context.DeadlineExceeded)
+	}
+	if wait <= 0 {
+		return nil
+	}
+	atomic.AddUint64(&l.waited, 1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return toContextRerror(ctx.Err())
+	}
+}
+
+func (b *bucket) refillLocked(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve reserves a token and returns the time to wait for it,
+// ok is false if the token is not available at once for the fail-fast bucket or before the ctx deadline.
+func (b *bucket) reserve(ctx context.Context) (wait time.Duration, ok bool) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.failFast {
+		return 0, false
+	}
+	wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if deadline, has := ctx.Deadline(); has && now.Add(wait).After(deadline) {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// cancel returns the reserved token.
+func (b *bucket) cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+	b.mu.Unlock()
+}
+
+func (b *bucket) getStats() BucketStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	return BucketStats{
+		Tokens:      b.tokens,
+		Utilisation: (b.burst - b.tokens) / b.burst,
+	}
+}
+
+func (l *limiter) getStats() *LimiterStats {
+	if l == nil {
+		return nil
+	}
+	s := &LimiterStats{
+		Uris:     make(map[string]BucketStats, len(l.uris)),
+		Waited:   atomic.LoadUint64(&l.waited),
+		Rejected: atomic.LoadUint64(&l.rejected),
+	}
+	if l.global != nil {
+		g := l.global.getStats()
+		s.Global = &g
+	}
+	for uri, b := range l.uris {
+		s.Uris[uri] = b.getStats()
+	}
+	if l.inflight != nil {
+		s.Inflight = len(l.inflight)
+		s.InflightUtilisation = float64(s.Inflight) / float64(cap(l.inflight))
+	}
+	return s
+}
+
+// maxInflight returns the concurrency limit, 0 if there is no limit.
+func (l *limiter) maxInflight() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.inflight)
+}
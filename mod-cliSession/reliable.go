@@ -0,0 +1,527 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/codec"
+)
+
+const (
+	// PUSH_ID_META_KEY the ID of the reliable push.
+	PUSH_ID_META_KEY = "X-Push-Id"
+	// PUSH_ACK_URI the URI of the acknowledgement that the server pushes back for each reliable push.
+	PUSH_ACK_URI = "/reliable_push_ack"
+)
+
+// ErrReliablePusherClosed the error returned when the reliable pusher is closed.
+var ErrReliablePusherClosed = errors.New("cliSession: reliable pusher is closed")
+
+// ReliableConfig the configuration of the reliable push.
+type ReliableConfig struct {
+	// SpoolFile the path of the write-ahead spool file of the unacknowledged pushes.
+	SpoolFile string
+	// NoSync skips the fsync after each append, which is faster,
+	// but the pushes appended just before an OS crash may be lost.
+	NoSync bool
+	// AckTimeout re-sends the push if it is not acknowledged in time, default 5s.
+	AckTimeout time.Duration
+	// MaxInflight the maximum number of the sent but unacknowledged pushes, default 100.
+	MaxInflight int
+}
+
+// ReliablePusher delivers the pushes of a CliSession at least once.
+// Each push is assigned an ID and appended to the spool file before being sent,
+// and is re-sent until the server acknowledges it;
+// the unacknowledged pushes in the spool file are replayed when it is reopened.
+// Note:
+// The server should register the plugin of NewReliablePushPlugin, which deduplicates the pushes,
+// and each push handler should call AckReliablePush after the push is handled successfully;
+// The client peer should register the plugin of NewReliableAckPlugin, which receives the acknowledgements;
+// The arg is marshalled and sent by JSON.
+type ReliablePusher struct {
+	cli     *CliSession
+	cfg     ReliableConfig
+	file    *os.File
+	idPre   string
+	idSeq   uint64
+	entries map[string]*spoolEntry
+	order   []*spoolEntry
+	acked   int
+	notify  chan struct{}
+	closeCh chan struct{}
+	done    chan struct{}
+	closed  bool
+	mu      sync.Mutex
+}
+
+type spoolEntry struct {
+	Op     string          `json:"op"`
+	Id     string          `json:"id"`
+	Uri    string          `json:"uri,omitempty"`
+	Arg    json.RawMessage `json:"arg,omitempty"`
+	sentAt time.Time
+}
+
+const (
+	spoolOpPush = "push"
+	spoolOpAck  = "ack"
+	// spoolCompactThreshold the spool file is compacted after so many acknowledgements.
+	spoolCompactThreshold = 1024
+)
+
+// NewReliablePusher opens the spool file, replays the unacknowledged pushes in it,
+// and starts delivering the pushes by the cli.
+func NewReliablePusher(cli *CliSession, cfg ReliableConfig) (*ReliablePusher, error) {
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = time.Second * 5
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = 100
+	}
+	var pre [8]byte
+	if _, err := rand.Read(pre[:]); err != nil {
+		return nil, err
+	}
+	r := &ReliablePusher{
+		cli:     cli,
+		cfg:     cfg,
+		idPre:   hex.EncodeToString(pre[:]),
+		entries: make(map[string]*spoolEntry),
+		notify:  make(chan struct{}, 1),
+		closeCh: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if err := r.compact(); err != nil {
+		return nil, err
+	}
+	if len(r.order) > 0 {
+		tp.Infof("cliSession: replay %d unacknowledged pushes from %s", len(r.order), cfg.SpoolFile)
+	}
+	cli.optMu.Lock()
+	cli.reliable = r
+	cli.optMu.Unlock()
+	go r.run()
+	r.wake()
+	return r, nil
+}
+
+// load reads the unacknowledged pushes from the spool file.
+func (r *ReliablePusher) load() error {
+	f, err := os.Open(r.cfg.SpoolFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line may be torn by a crash.
+			tp.Warnf("cliSession: skip the bad line of the spool file %s: %v", r.cfg.SpoolFile, err)
+			continue
+		}
+		switch e.Op {
+		case spoolOpPush:
+			entry := e
+			r.entries[e.Id] = &entry
+			r.order = append(r.order, &entry)
+		case spoolOpAck:
+			delete(r.entries, e.Id)
+		}
+	}
+	r.pruneOrder()
+	return scanner.Err()
+}
+
+// compact rewrites the spool file with only the unacknowledged pushes.
+func (r *ReliablePusher) compact() error {
+	tmp := r.cfg.SpoolFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range r.order {
+		b, _ := json.Marshal(e)
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, r.cfg.SpoolFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, err = os.OpenFile(r.cfg.SpoolFile, os.O_APPEND|os.O_WRONLY, 0644)
+	r.acked = 0
+	return err
+}
+
+// appendLocked appends the entry to the spool file.
+func (r *ReliablePusher) appendLocked(e *spoolEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = r.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if r.cfg.NoSync {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Push appends the push to the spool file and returns its ID, then it is delivered in the background.
+func (r *ReliablePusher) Push(uri string, arg interface{}) (id string, err error) {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return "", ErrReliablePusherClosed
+	}
+	e := &spoolEntry{
+		Op:  spoolOpPush,
+		Id:  fmt.Sprintf("%s-%d", r.idPre, r.idSeq+1),
+		Uri: uri,
+		Arg: b,
+	}
+	if err = r.appendLocked(e); err != nil {
+		return "", err
+	}
+	r.idSeq++
+	r.entries[e.Id] = e
+	r.order = append(r.order, e)
+	r.wake()
+	return e.Id, nil
+}
+
+// Pending returns the number of the unacknowledged pushes.
+func (r *ReliablePusher) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// Close stops delivering, the unacknowledged pushes are kept in the spool file.
+func (r *ReliablePusher) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.closeCh)
+	r.mu.Unlock()
+	<-r.done
+	r.cli.optMu.Lock()
+	if r.cli.reliable == r {
+		r.cli.reliable = nil
+	}
+	r.cli.optMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *ReliablePusher) wake() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ack removes the acknowledged push.
+func (r *ReliablePusher) ack(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[id]; !ok || r.closed {
+		return
+	}
+	delete(r.entries, id)
+	if err := r.appendLocked(&spoolEntry{Op: spoolOpAck, Id: id}); err != nil {
+		tp.Warnf("cliSession: append the ack of %s to the spool file error: %v", id, err)
+	}
+	r.acked++
+	if r.acked >= spoolCompactThreshold && r.acked >= len(r.entries) {
+		r.pruneOrder()
+		if err := r.compact(); err != nil {
+			tp.Warnf("cliSession: compact the spool file error: %v", err)
+		}
+	}
+	r.wake()
+}
+
+// pruneOrder removes the acknowledged pushes from the order.
+func (r *ReliablePusher) pruneOrder() {
+	order := r.order[:0]
+	for _, e := range r.order {
+		if _, ok := r.entries[e.Id]; ok {
+			order = append(order, e)
+		}
+	}
+	for i := len(order); i < len(r.order); i++ {
+		r.order[i] = nil
+	}
+	r.order = order
+}
+
+func (r *ReliablePusher) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.AckTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeCh:
+			return
+		case <-r.notify:
+		case <-ticker.C:
+		}
+		r.sendDue()
+	}
+}
+
+// sendDue sends the pushes that are not sent or whose acknowledgement timed out.
+func (r *ReliablePusher) sendDue() {
+	now := time.Now()
+	r.mu.Lock()
+	r.pruneOrder()
+	inflight := 0
+	var due []*spoolEntry
+	for _, e := range r.order {
+		if !e.sentAt.IsZero() && now.Sub(e.sentAt) < r.cfg.AckTimeout {
+			inflight++
+		}
+	}
+	for _, e := range r.order {
+		if inflight >= r.cfg.MaxInflight {
+			break
+		}
+		if e.sentAt.IsZero() || now.Sub(e.sentAt) >= r.cfg.AckTimeout {
+			e.sentAt = now
+			due = append(due, e)
+			inflight++
+		}
+	}
+	r.mu.Unlock()
+	for i, e := range due {
+		rerr := r.cli.Push(e.Uri, []byte(e.Arg),
+			tp.WithBodyCodec(codec.ID_JSON),
+			tp.WithSetMeta(PUSH_ID_META_KEY, e.Id),
+		)
+		if rerr != nil {
+			tp.Debugf("cliSession: reliable push %s error: %v", e.Id, rerr)
+			// the rest is sent in the next round.
+			r.mu.Lock()
+			for _, e := range due[i+1:] {
+				e.sentAt = time.Time{}
+			}
+			r.mu.Unlock()
+			return
+		}
+		select {
+		case <-r.closeCh:
+			return
+		default:
+		}
+	}
+}
+
+// NewReliableAckPlugin creates a client-side plugin that routes the acknowledgements of the reliable pushes.
+// Note: It should be registered when creating the peer of the CliSession.
+func NewReliableAckPlugin() tp.Plugin {
+	return new(reliableAckPlugin)
+}
+
+type reliableAckPlugin struct{}
+
+var _ tp.PostNewPeerPlugin = new(reliableAckPlugin)
+
+func (*reliableAckPlugin) Name() string {
+	return "reliable_ack"
+}
+
+func (*reliableAckPlugin) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.RoutePushFunc((*reliableAck).ReliablePushAck)
+	return nil
+}
+
+type reliableAck struct {
+	tp.PushCtx
+}
+
+// ReliablePushAck handles the PUSH_ACK_URI push.
+func (ctx *reliableAck) ReliablePushAck(_ *struct{}) *tp.Rerror {
+	if v, ok := ctx.Session().Swap().Load(cliSessionSwapKey); ok {
+		if r := v.(*CliSession).getReliable(); r != nil {
+			r.ack(goutil.BytesToString(ctx.PeekMeta(PUSH_ID_META_KEY)))
+		}
+	}
+	return nil
+}
+
+func (c *CliSession) getReliable() *ReliablePusher {
+	c.optMu.RLock()
+	r := c.reliable
+	c.optMu.RUnlock()
+	return r
+}
+
+// NewReliablePushPlugin creates a server-side plugin that discards the duplicate reliable pushes
+// among the last dedupeSize(default 100000) IDs acknowledged by AckReliablePush,
+// and acknowledges them again in case the last acknowledgement is lost.
+// Note: It should be registered when creating the peer.
+func NewReliablePushPlugin(dedupeSize int) tp.Plugin {
+	if dedupeSize <= 0 {
+		dedupeSize = 100000
+	}
+	return &reliablePushPlugin{
+		seen: make(map[string]struct{}, dedupeSize),
+		ring: make([]string, dedupeSize),
+	}
+}
+
+type reliablePushPlugin struct {
+	seen map[string]struct{}
+	ring []string
+	next int
+	mu   sync.Mutex
+}
+
+var (
+	_ tp.PostNewPeerPlugin        = new(reliablePushPlugin)
+	_ tp.PostReadPushHeaderPlugin = new(reliablePushPlugin)
+	_ tp.PostReadPushBodyPlugin   = new(reliablePushPlugin)
+)
+
+// the URI where the duplicate reliable pushes are routed to be discarded.
+const pushDuplicateUri = "/reliable_push_duplicate"
+
+func (*reliablePushPlugin) Name() string {
+	return "reliable_push"
+}
+
+func (*reliablePushPlugin) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.RoutePushFunc((*reliableDuplicate).ReliablePushDuplicate)
+	return nil
+}
+
+type reliableDuplicate struct {
+	tp.PushCtx
+}
+
+// ReliablePushDuplicate discards the duplicate reliable push.
+func (*reliableDuplicate) ReliablePushDuplicate(_ *json.RawMessage) *tp.Rerror {
+	return nil
+}
+
+func (p *reliablePushPlugin) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	id := goutil.BytesToString(ctx.PeekMeta(PUSH_ID_META_KEY))
+	if len(id) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	_, dup := p.seen[id]
+	p.mu.Unlock()
+	if !dup {
+		return nil
+	}
+	p.ack(ctx.Session(), id)
+	// discard it instead of the handler.
+	ctx.UriObject().Path = pushDuplicateUri
+	return nil
+}
+
+func (p *reliablePushPlugin) PostReadPushBody(ctx tp.ReadCtx) *tp.Rerror {
+	id := string(ctx.PeekMeta(PUSH_ID_META_KEY))
+	if len(id) == 0 {
+		return nil
+	}
+	ctx.Swap().Store(reliablePushSwapKey, &reliablePush{plugin: p, id: id})
+	return nil
+}
+
+const reliablePushSwapKey swapKey = "reliable_push"
+
+// reliablePush the reliable push being handled.
+type reliablePush struct {
+	plugin *reliablePushPlugin
+	id     string
+}
+
+// AckReliablePush acknowledges the reliable push being handled, and records its ID to discard the duplicates.
+// Note:
+// It should be called by the push handler after the push is handled successfully,
+// otherwise the push is re-sent by the client;
+// It does nothing if the push is not reliable or the plugin of NewReliablePushPlugin is not registered.
+func AckReliablePush(ctx tp.PushCtx) {
+	v, ok := ctx.Swap().Load(reliablePushSwapKey)
+	if !ok {
+		return
+	}
+	ctx.Swap().Delete(reliablePushSwapKey)
+	r := v.(*reliablePush)
+	r.plugin.record(r.id)
+	r.plugin.ack(ctx.Session(), r.id)
+}
+
+// record records the ID of the handled push.
+func (p *reliablePushPlugin) record(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.seen[id]; ok {
+		return
+	}
+	delete(p.seen, p.ring[p.next])
+	p.ring[p.next] = id
+	p.next = (p.next + 1) % len(p.ring)
+	p.seen[id] = struct{}{}
+}
+
+func (p *reliablePushPlugin) ack(sess tp.Session, id string) {
+	if rerr := sess.Push(PUSH_ACK_URI, nil, tp.WithSetMeta(PUSH_ID_META_KEY, id)); rerr != nil {
+		tp.Debugf("reliable push: acknowledge %s error: %v", id, rerr)
+	}
+}
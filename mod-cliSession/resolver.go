@@ -0,0 +1,271 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"gopkg.in/yaml.v2"
+)
+
+// Resolver resolves the addresses of the cluster.
+type Resolver interface {
+	// Resolve returns the current addresses.
+	Resolve() ([]string, error)
+	// Watch returns a channel that receives the whole new addresses when they change.
+	Watch() <-chan []string
+	// Close stops watching and closes the watch channel.
+	Close() error
+}
+
+// NewStaticResolver returns a resolver of the fixed addresses.
+func NewStaticResolver(addrs ...string) Resolver {
+	return &staticResolver{
+		addrs: normalizeAddrs(addrs),
+		ch:    make(chan []string),
+	}
+}
+
+type staticResolver struct {
+	addrs []string
+	ch    chan []string
+	once  sync.Once
+}
+
+func (s *staticResolver) Resolve() ([]string, error) {
+	return s.addrs, nil
+}
+
+func (s *staticResolver) Watch() <-chan []string {
+	return s.ch
+}
+
+func (s *staticResolver) Close() error {
+	s.once.Do(func() {
+		close(s.ch)
+	})
+	return nil
+}
+
+// NewFileResolver returns a resolver that re-reads the address list file every interval.
+// If the file extension is .json, it is decoded as JSON, otherwise as YAML.
+// e.g. `["127.0.0.1:9090", "127.0.0.1:9091"]` or
+//   - 127.0.0.1:9090
+//   - 127.0.0.1:9091
+func NewFileResolver(filename string, interval time.Duration) Resolver {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return newPollResolver(interval, func() ([]string, error) {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var addrs []string
+		if ext == ".json" {
+			err = json.Unmarshal(b, &addrs)
+		} else {
+			err = yaml.Unmarshal(b, &addrs)
+		}
+		return addrs, err
+	})
+}
+
+// NewDNSResolver returns a resolver that looks up the A/AAAA records of the host every interval,
+// and joins each IP with the port.
+// Note: If r is nil, use net.DefaultResolver.
+func NewDNSResolver(host string, port int, interval time.Duration, r *net.Resolver) Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	p := strconv.Itoa(port)
+	return newPollResolver(interval, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		defer cancel()
+		ips, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.JoinHostPort(ip, p)
+		}
+		return addrs, nil
+	})
+}
+
+// NewDNSSRVResolver returns a resolver that looks up the SRV records of _service._proto.name every interval.
+// Note: If r is nil, use net.DefaultResolver.
+func NewDNSSRVResolver(service, proto, name string, interval time.Duration, r *net.Resolver) Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return newPollResolver(interval, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		defer cancel()
+		_, srvs, err := r.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(srvs))
+		for i, srv := range srvs {
+			addrs[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		}
+		return addrs, nil
+	})
+}
+
+// NewStubNetResolver returns a *net.Resolver that sends all the DNS queries to the dnsAddr,
+// e.g. a local stub resolver "127.0.0.1:53".
+func NewStubNetResolver(dnsAddr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dnsAddr)
+		},
+	}
+}
+
+const (
+	dnsLookupTimeout       = time.Second * 5
+	defaultResolveInterval = time.Second * 30
+)
+
+type pollResolver struct {
+	lookup   func() ([]string, error)
+	interval time.Duration
+	ch       chan []string
+	closeCh  chan struct{}
+	once     sync.Once
+	last     []string
+	mu       sync.Mutex
+}
+
+func newPollResolver(interval time.Duration, lookup func() ([]string, error)) *pollResolver {
+	if interval <= 0 {
+		interval = defaultResolveInterval
+	}
+	p := &pollResolver{
+		lookup:   lookup,
+		interval: interval,
+		ch:       make(chan []string, 1),
+		closeCh:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *pollResolver) Resolve() ([]string, error) {
+	addrs, err := p.lookup()
+	if err != nil {
+		return nil, err
+	}
+	addrs = normalizeAddrs(addrs)
+	p.mu.Lock()
+	p.last = addrs
+	p.mu.Unlock()
+	return addrs, nil
+}
+
+func (p *pollResolver) Watch() <-chan []string {
+	return p.ch
+}
+
+func (p *pollResolver) Close() error {
+	p.once.Do(func() {
+		close(p.closeCh)
+	})
+	return nil
+}
+
+func (p *pollResolver) run() {
+	ticker := time.NewTicker(p.interval)
+	defer func() {
+		ticker.Stop()
+		close(p.ch)
+	}()
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case <-ticker.C:
+		}
+		addrs, err := p.lookup()
+		if err != nil {
+			// keep the last addresses when the lookup fails.
+			tp.Warnf("cliSession: resolve addresses error: %v", err)
+			continue
+		}
+		addrs = normalizeAddrs(addrs)
+		p.mu.Lock()
+		changed := !equalAddrs(p.last, addrs)
+		p.last = addrs
+		p.mu.Unlock()
+		if !changed {
+			continue
+		}
+		select {
+		case <-p.ch:
+			// drop the stale addresses that have not been received.
+		default:
+		}
+		select {
+		case p.ch <- addrs:
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// normalizeAddrs returns the sorted and deduplicated non-empty addresses.
+func normalizeAddrs(addrs []string) []string {
+	r := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if len(addr) > 0 {
+			r = append(r, addr)
+		}
+	}
+	sort.Strings(r)
+	n := 0
+	for i, addr := range r {
+		if i == 0 || addr != r[n-1] {
+			r[n] = addr
+			n++
+		}
+	}
+	return r[:n]
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// RetryPolicy the retry policy of *CliSession.Pull.
+// Each retry hires a fresh session from the pool.
+type RetryPolicy struct {
+	// MaxAttempts the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff the backoff before the first retry, default 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff the upper limit of the backoff, default 5s.
+	MaxBackoff time.Duration
+	// Multiplier the growth factor of the backoff, default 2.
+	Multiplier float64
+	// Jitter randomizes the backoff in the range of [backoff*(1-Jitter), backoff*(1+Jitter)].
+	Jitter float64
+	// RetryableCodes the Rerror codes that can be retried,
+	// default CodeDialFailed, CodeConnClosed and CodeWriteFailed.
+	RetryableCodes []int32
+	// IdempotentUris the URI paths that are allowed to be re-sent.
+	// Note: If the pull has not been sent(e.g. failed to dial), it is always allowed to retry.
+	IdempotentUris []string
+}
+
+// DefaultRetryableCodes the default Rerror codes that can be retried.
+var DefaultRetryableCodes = []int32{
+	tp.CodeDialFailed,
+	tp.CodeConnClosed,
+	tp.CodeWriteFailed,
+}
+
+// SetRetryPolicy sets the retry policy of the pull.
+// Note: If policy is nil, do not retry.
+func (c *CliSession) SetRetryPolicy(policy *RetryPolicy) {
+	if policy != nil {
+		policy = policy.normalize()
+	}
+	c.optMu.Lock()
+	c.retryPolicy = policy
+	c.optMu.Unlock()
+}
+
+func (c *CliSession) getRetryPolicy() *RetryPolicy {
+	c.optMu.RLock()
+	policy := c.retryPolicy
+	c.optMu.RUnlock()
+	return policy
+}
+
+func (r *RetryPolicy) normalize() *RetryPolicy {
+	p := *r
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Millisecond * 100
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second * 5
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = DefaultRetryableCodes
+	}
+	p.RetryableCodes = append([]int32(nil), p.RetryableCodes...)
+	p.IdempotentUris = append([]string(nil), p.IdempotentUris...)
+	return &p
+}
+
+// shouldRetry returns whether to retry after the attempt-th failure.
+func (r *RetryPolicy) shouldRetry(attempt int, uri string, sent bool, rerr *tp.Rerror) bool {
+	if r == nil || rerr == nil || attempt >= r.MaxAttempts {
+		return false
+	}
+	if !r.isRetryableCode(rerr.Code) {
+		return false
+	}
+	return !sent || r.isIdempotent(uri)
+}
+
+func (r *RetryPolicy) isRetryableCode(code int32) bool {
+	for _, c := range r.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RetryPolicy) isIdempotent(uri string) bool {
+	path := uriPath(uri)
+	for _, u := range r.IdempotentUris {
+		if u == path {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the waiting time before the next attempt.
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(r.InitialBackoff) * math.Pow(r.Multiplier, float64(attempt-1))
+	if d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d *= 1 - r.Jitter + 2*r.Jitter*rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// uriPath returns the path part of the URI.
+func uriPath(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
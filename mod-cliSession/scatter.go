@@ -0,0 +1,207 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// CodeQuorumFailed the Rerror code returned when not enough pulls of the batch succeed.
+const CodeQuorumFailed int32 = 1502
+
+// PullReq a pull of the batch.
+type PullReq struct {
+	Uri     string
+	Arg     interface{}
+	Result  interface{}
+	Setting []socket.PacketSetting
+}
+
+// GatherMode the mode of gathering the replies of the batch.
+type GatherMode int
+
+const (
+	// GatherAll waits for all the pulls, the Rerror of each pull is in its PullCmd.
+	GatherAll GatherMode = iota
+	// GatherFirstSuccess returns once one pull succeeds, it fails if all the pulls fail.
+	GatherFirstSuccess
+	// GatherQuorum returns once ScatterOptions.Quorum pulls succeed,
+	// it fails as soon as the quorum can not be reached.
+	GatherQuorum
+)
+
+// ScatterOptions the options of the batch pulls.
+type ScatterOptions struct {
+	// Mode the mode of gathering the replies, default GatherAll.
+	Mode GatherMode
+	// Quorum the number of the successful pulls to wait for in GatherQuorum mode.
+	Quorum int
+	// Concurrency the maximum number of the in-flight pulls, 0 means no limit.
+	Concurrency int
+}
+
+var rerrQuorumDecided = tp.NewRerror(CodeCanceled, "Canceled", "the batch has been decided")
+
+type scatterCall struct {
+	index int
+	start time.Time
+	done  func() tp.PullCmd
+}
+
+// PullAll sends the batch of pulls concurrently and gathers the replies according to the opt.Mode.
+// The returned PullCmds are in the order of the reqs, the pulls that are not sent or replied in time
+// have the PullCmds with CodeCanceled or the ctx error.
+// The returned Rerror is not nil if the ctx is done or the mode can not be satisfied.
+// Note:
+// The pulls are sent by AsyncPull on a shared channel, without a goroutine for each pull;
+// The pulls are not retried or hedged, but re-sent once if the token expired, see Authenticator.ExpiredCodes;
+// The late replies may still be written into the results.
+func (c *CliSession) PullAll(ctx context.Context, reqs []PullReq, opt ScatterOptions) ([]tp.PullCmd, *tp.Rerror) {
+	n := len(reqs)
+	pullCmds := make([]tp.PullCmd, n)
+	if n == 0 {
+		return pullCmds, nil
+	}
+	limit := opt.Concurrency
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	// the in-flight slots are released only after the replies are received here.
+	if max := c.getLimiter().maxInflight(); max > 0 && limit > max {
+		limit = max
+	}
+	quorum := n
+	switch opt.Mode {
+	case GatherFirstSuccess:
+		quorum = 1
+	case GatherQuorum:
+		quorum = opt.Quorum
+		if quorum <= 0 || quorum > n {
+			quorum = n
+		}
+	}
+
+	ch := make(chan tp.PullCmd, limit)
+	pending := make(map[tp.PullCmd]scatterCall, limit)
+	var (
+		next, succeeded, failed int
+		lastRerr                *tp.Rerror
+	)
+	decided := func() bool {
+		if opt.Mode == GatherAll {
+			return next == n && len(pending) == 0
+		}
+		return succeeded >= quorum || n-failed < quorum
+	}
+	for !decided() && ctx.Err() == nil {
+		for next < n && len(pending) < limit {
+			req := reqs[next]
+			call := scatterCall{index: next, start: time.Now()}
+			var pullCmd tp.PullCmd
+			setting, rerr := withTimeoutMeta(ctx, req.Setting)
+			if rerr != nil {
+				pullCmd = fakeAsyncPull(req.Uri, req.Arg, req.Result, ch, rerr)
+			} else {
+				pullCmd, call.done = c.asyncPull(ctx, req.Uri, req.Arg, req.Result, ch, setting)
+			}
+			pending[pullCmd] = call
+			next++
+		}
+		select {
+		case pullCmd := <-ch:
+			call := pending[pullCmd]
+			delete(pending, pullCmd)
+			if call.done != nil {
+				if resent := call.done(); resent != nil {
+					// re-sent after the re-authentication.
+					pending[resent] = call
+					continue
+				}
+			}
+			rerr := pullCmd.Rerror()
+			c.metrics.observe(reqs[call.index].Uri, time.Since(call.start), rerr)
+			pullCmds[call.index] = pullCmd
+			if rerr == nil {
+				succeeded++
+			} else {
+				failed++
+				lastRerr = rerr
+			}
+		case <-ctx.Done():
+		}
+	}
+
+	var (
+		complete      = next == n && len(pending) == 0
+		rerrAbandoned = rerrQuorumDecided
+	)
+	if err := ctx.Err(); err != nil && !complete {
+		rerrAbandoned = toContextRerror(err)
+	}
+	for i, pullCmd := range pullCmds {
+		if pullCmd == nil {
+			pullCmds[i] = tp.NewFakePullCmd(reqs[i].Uri, reqs[i].Arg, reqs[i].Result, rerrAbandoned)
+		}
+	}
+	if !complete {
+		// finish the abandoned pulls in the background.
+		tp.Go(func() {
+			for len(pending) > 0 {
+				pullCmd := <-ch
+				call := pending[pullCmd]
+				delete(pending, pullCmd)
+				if call.done != nil {
+					if resent := call.done(); resent != nil {
+						pending[resent] = call
+					}
+				}
+			}
+		})
+	}
+
+	if opt.Mode == GatherAll {
+		if complete {
+			return pullCmds, nil
+		}
+	} else if succeeded >= quorum {
+		return pullCmds, nil
+	}
+	if ctx.Err() != nil {
+		return pullCmds, rerrAbandoned
+	}
+	return pullCmds, tp.NewRerror(CodeQuorumFailed, "Quorum Failed",
+		fmt.Sprintf("%d of %d pulls succeeded, the quorum is %d, the last error: %s", succeeded, n, quorum, lastRerr.Message))
+}
+
+// Scatter pulls the uri with each of the args concurrently, e.g. to call one URI across many shards,
+// and gathers the replies according to the opt.Mode.
+// The newResult creates the result of each pull, and the returned PullCmds are in the order of the args.
+func (c *CliSession) Scatter(ctx context.Context, uri string, args []interface{}, newResult func() interface{}, opt ScatterOptions, setting ...socket.PacketSetting) ([]tp.PullCmd, *tp.Rerror) {
+	reqs := make([]PullReq, len(args))
+	for i, arg := range args {
+		reqs[i] = PullReq{
+			Uri:     uri,
+			Arg:     arg,
+			Result:  newResult(),
+			Setting: setting,
+		}
+	}
+	return c.PullAll(ctx, reqs, opt)
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliSession
+
+import (
+	"context"
+	"sync"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+var rerrShuttingDown = tp.NewRerror(tp.CodeConnClosed, "Connection Closed", "the session is shutting down")
+
+// drainer tracks the in-flight calls for the graceful shutdown.
+type drainer struct {
+	inflight int
+	closing  bool
+	drained  chan struct{}
+	mu       sync.Mutex
+}
+
+// begin registers a call, it fails if the session is shutting down.
+func (d *drainer) begin() *tp.Rerror {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return rerrShuttingDown
+	}
+	d.inflight++
+	return nil
+}
+
+// end unregisters a call that is registered by begin.
+func (d *drainer) end() {
+	d.mu.Lock()
+	d.inflight--
+	if d.inflight == 0 && d.drained != nil {
+		close(d.drained)
+		d.drained = nil
+	}
+	d.mu.Unlock()
+}
+
+// drain rejects the new calls, and waits for the in-flight calls to finish or the ctx to be done.
+// It returns the number of the calls that are still in flight.
+func (d *drainer) drain(ctx context.Context) int {
+	d.mu.Lock()
+	d.closing = true
+	if d.inflight > 0 && d.drained == nil {
+		d.drained = make(chan struct{})
+	}
+	drained := d.drained
+	d.mu.Unlock()
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight
+}
+
+// Shutdown gracefully closes the session.
+// It stops accepting new pulls and pushes, waits for the in-flight ones to finish or the ctx to be done,
+// and then closes the pooled sessions.
+// It returns the number of the in-flight calls that are abandoned.
+func (c *CliSession) Shutdown(ctx context.Context) (abandoned int) {
+	abandoned = c.drainer.drain(ctx)
+	c.Close()
+	if abandoned > 0 {
+		tp.Warnf("cliSession: shutdown %s abandoned %d in-flight calls", c.addr, abandoned)
+	}
+	return abandoned
+}
+
+// Shutdown gracefully closes the sessions of all the addresses.
+// It returns the total number of the in-flight calls that are abandoned.
+func (c *ClusterSession) Shutdown(ctx context.Context) (abandoned int) {
+	nodes := c.stop()
+	counts := make([]int, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, n := range nodes {
+		go func(i int, n *Node) {
+			defer wg.Done()
+			counts[i] = n.sess.Shutdown(ctx)
+		}(i, n)
+	}
+	wg.Wait()
+	for _, n := range counts {
+		abandoned += n
+	}
+	return abandoned
+}
@@ -1,6 +1,7 @@
 package heartbeat_test
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -79,3 +80,264 @@ func TestHeartbeatPush2(t *testing.T) {
 	}
 	time.Sleep(time.Second * 5)
 }
+
+func TestHeartbeatNegotiate(t *testing.T) {
+	pong := heartbeat.NewPong()
+	pong.SetRateRange(5, 10)
+	pong.SetRatePolicy(func(sess tp.Session, rateSecond int) int {
+		t.Logf("pong: %s requests rate %ds", sess.Id(), rateSecond)
+		return rateSecond
+	})
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9091},
+		pong,
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := tp.NewPeer(
+		tp.PeerConfig{},
+		heartbeat.NewPing(3, true),
+	)
+	sess, _ := cli.Dial(":9091")
+	// the PUSH heartbeat rate is clamped to the range too.
+	pushCli := tp.NewPeer(
+		tp.PeerConfig{},
+		heartbeat.NewPing(3, false),
+	)
+	pushSess, _ := pushCli.Dial(":9091")
+	// the ping adopts the rate 5s after the first heartbeat, at the 3rd second.
+	time.Sleep(time.Second * 5)
+	if rate, _ := heartbeat.SessionRate(sess); rate != time.Second*5 {
+		t.Fatalf("the ping should adopt the rate 5s, but get %s", rate)
+	}
+	srv.RangeSession(func(s tp.Session) bool {
+		if rate, _ := heartbeat.SessionRate(s); rate != time.Second*5 {
+			t.Fatalf("the pong should accept the rate 5s, but get %s", rate)
+		}
+		return true
+	})
+	time.Sleep(time.Second * 7)
+	if !sess.Health() || !pushSess.Health() {
+		t.Fatal("the sessions should be alive")
+	}
+}
+
+func TestHeartbeatRTT(t *testing.T) {
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9092},
+		heartbeat.NewPong(),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := tp.NewPeer(
+		tp.PeerConfig{},
+		heartbeat.NewPing(3, true),
+	)
+	sess, _ := cli.Dial(":9092")
+	time.Sleep(time.Second * 8)
+	rtt, ok := heartbeat.SessionRTT(sess)
+	if !ok {
+		t.Fatal("the RTT should be measured")
+	}
+	t.Logf("%+v", rtt)
+	if rtt.Samples == 0 {
+		t.Fatal("expect the samples measured")
+	}
+	if rtt.Last <= 0 || rtt.Average <= 0 || rtt.Average >= time.Second*3 {
+		t.Fatalf("expect the RTT in (0, 3s), but get %+v", rtt)
+	}
+	if rtt.Jitter < 0 || rtt.Jitter >= time.Second*3 {
+		t.Fatalf("expect the jitter in [0, 3s), but get %+v", rtt)
+	}
+}
+
+func TestHeartbeatHooks(t *testing.T) {
+	var suspected, timeouts int32
+	pong := heartbeat.NewPong()
+	pong.SetHooks(heartbeat.Hooks{
+		OnSuspect: func(sess tp.Session, lastSeen time.Time) {
+			t.Logf("suspect: %s, last seen: %s", sess.Id(), lastSeen)
+			atomic.AddInt32(&suspected, 1)
+		},
+		OnTimeout: func(sess tp.Session, lastSeen time.Time) time.Duration {
+			t.Logf("timeout: %s, last seen: %s", sess.Id(), lastSeen)
+			if atomic.AddInt32(&timeouts, 1) == 1 {
+				// defer the first close
+				return time.Second * 2
+			}
+			return 0
+		},
+	})
+	defer pong.Stop()
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9093},
+		pong,
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := tp.NewPeer(tp.PeerConfig{})
+	sess, _ := cli.Dial(":9093")
+	// a heartbeat without the ping plugin, then keep idle.
+	sess.Pull(heartbeat.HeartbeatUri+"?hb_=3", nil, nil)
+	time.Sleep(time.Second * 7)
+	if !sess.Health() {
+		t.Fatal("the close should be deferred")
+	}
+	time.Sleep(time.Second * 3)
+	if sess.Health() {
+		t.Fatal("the session should be closed")
+	}
+	if atomic.LoadInt32(&suspected) != 1 || atomic.LoadInt32(&timeouts) != 2 {
+		t.Fatalf("suspected: %d, timeouts: %d", suspected, timeouts)
+	}
+}
+
+func TestHeartbeatPingPong(t *testing.T) {
+	// the peer both pings and pongs
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9097},
+		heartbeat.NewPing(60, true),
+		heartbeat.NewPong(),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	cli := tp.NewPeer(tp.PeerConfig{})
+	sess, _ := cli.Dial(":9097")
+	// a heartbeat without the ping plugin, then keep idle.
+	sess.Pull(heartbeat.HeartbeatUri+"?hb_=3", nil, nil)
+	time.Sleep(time.Second * 10)
+	if sess.Health() {
+		t.Fatal("the dead session should be closed by the pong")
+	}
+}
+
+func TestHeartbeatLoadReport(t *testing.T) {
+	pong := heartbeat.NewPong()
+	pong.EnableLoadReport(func() float64 { return 0.5 })
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9094},
+		pong,
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	ping := heartbeat.NewPing(3, true)
+	ping.EnableLoadReport(nil)
+	cli := tp.NewPeer(
+		tp.PeerConfig{},
+		ping,
+	)
+	sess, _ := cli.Dial(":9094")
+	time.Sleep(time.Second * 5)
+	report, ok := heartbeat.RemoteLoad(sess)
+	if !ok || report.Score != 0.5 || report.Sessions != 1 {
+		t.Fatalf("server load: %+v", report)
+	}
+	t.Logf("server load: %+v", report)
+	srv.RangeSession(func(sess tp.Session) bool {
+		report, ok := heartbeat.RemoteLoad(sess)
+		if !ok {
+			t.Fatal("the client load should be received")
+		}
+		t.Logf("client load: %+v", report)
+		return true
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9095},
+		heartbeat.NewPong(),
+		heartbeat.NewIdleTimeout(heartbeat.IdleConfig{
+			Timeout:    time.Second * 4,
+			ExemptUris: []string{"/stats"},
+		}),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	var goingAway int32
+	cli := tp.NewPeer(
+		tp.PeerConfig{},
+		heartbeat.NewPing(3, true),
+	)
+	cli.SetUnknownPush(func(ctx tp.UnknownPushCtx) *tp.Rerror {
+		if ctx.Path() == heartbeat.GoingAwayUri {
+			t.Logf("going away: %s", ctx.InputBodyBytes())
+			atomic.AddInt32(&goingAway, 1)
+		}
+		return nil
+	})
+	sess, _ := cli.Dial(":9095")
+	// only the heartbeats and the exempt pushes
+	for i := 0; i < 3; i++ {
+		sess.Push("/stats", nil)
+		time.Sleep(time.Second * 2)
+	}
+	if sess.Health() {
+		t.Fatal("the idle session should be closed")
+	}
+	if atomic.LoadInt32(&goingAway) != 1 {
+		t.Fatal("the going away push should be received")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9096},
+		heartbeat.NewPong(),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+
+	var (
+		reconnected int32
+		newSess     atomic.Value
+	)
+	ping := heartbeat.NewPing(3, true)
+	ping.SetReconnect(&heartbeat.ReconnectConfig{
+		InitialBackoff: time.Second,
+		PostDial: func(sess tp.Session) *tp.Rerror {
+			t.Logf("post dial: %s", sess.Id())
+			return nil
+		},
+		OnEvent: func(event heartbeat.ReconnectEvent) {
+			t.Logf("reconnect: %+v", event)
+			if event.Session != nil {
+				newSess.Store(event.Session)
+				atomic.AddInt32(&reconnected, 1)
+			}
+		},
+	})
+	defer ping.Stop()
+	cli := tp.NewPeer(
+		tp.PeerConfig{},
+		ping,
+	)
+	heartbeat.Dial(cli, ":9096")
+	time.Sleep(time.Second)
+
+	// restart the server
+	srv.Close()
+	time.Sleep(time.Second * 2)
+	srv = tp.NewPeer(
+		tp.PeerConfig{ListenPort: 9096},
+		heartbeat.NewPong(),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second * 8)
+	if atomic.LoadInt32(&reconnected) != 1 {
+		t.Fatal("the session should be reconnected")
+	}
+
+	// the session closed locally is not redialed
+	newSess.Load().(tp.Session).Close()
+	time.Sleep(time.Second * 5)
+	if atomic.LoadInt32(&reconnected) != 1 {
+		t.Fatal("the session closed locally should not be reconnected")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// Hooks the events of the heartbeat state of the sessions.
+// A session becomes suspect when it misses a heartbeat, and is declared dead when it misses another one.
+// Note: The hooks are called in the goroutines apart from the heartbeat worker, so a slow hook does not stall the others.
+type Hooks struct {
+	// OnSuspect is called when the session becomes suspect.
+	OnSuspect func(sess tp.Session, lastSeen time.Time)
+	// OnRecover is called when the suspect session is alive again.
+	OnRecover func(sess tp.Session)
+	// OnTimeout is called when the session is declared dead, and returns the delay to defer the close,
+	// the session is checked again after the delay, 0 means closing the session now.
+	OnTimeout func(sess tp.Session, lastSeen time.Time) (deferClose time.Duration)
+}
+
+type hooksHolder struct {
+	hooks Hooks
+	mu    sync.RWMutex
+}
+
+// SetHooks sets the events of the heartbeat state of the sessions.
+func (h *hooksHolder) SetHooks(hooks Hooks) {
+	h.mu.Lock()
+	h.hooks = hooks
+	h.mu.Unlock()
+}
+
+func (h *hooksHolder) getHooks() Hooks {
+	h.mu.RLock()
+	hooks := h.hooks
+	h.mu.RUnlock()
+	return hooks
+}
+
+// fireSuspect marks the session suspect, and fires OnSuspect at the first time.
+func (h *hooksHolder) fireSuspect(sess tp.Session, info *heartbeatInfo) {
+	if info.setSuspect(true) {
+		h.onSuspect(sess, info)
+	}
+}
+
+// fireRecover clears the suspect mark of the session, and fires OnRecover if it was suspect.
+func (h *hooksHolder) fireRecover(sess tp.Session, info *heartbeatInfo) {
+	if info.setSuspect(false) {
+		h.onRecover(sess)
+	}
+}
+
+func (h *hooksHolder) onSuspect(sess tp.Session, info *heartbeatInfo) {
+	tp.Debugf("heartbeat: %s, suspect", sess.Id())
+	if fn := h.getHooks().OnSuspect; fn != nil {
+		fn(sess, info.getLast())
+	}
+}
+
+func (h *hooksHolder) onRecover(sess tp.Session) {
+	tp.Debugf("heartbeat: %s, recover", sess.Id())
+	if fn := h.getHooks().OnRecover; fn != nil {
+		fn(sess)
+	}
+}
+
+// fireTimeout fires OnTimeout, and returns the delay to defer the close, 0 means closing the session.
+func (h *hooksHolder) fireTimeout(sess tp.Session, info *heartbeatInfo) time.Duration {
+	fn := h.getHooks().OnTimeout
+	if fn == nil {
+		return 0
+	}
+	deferClose := fn(sess, info.getLast())
+	if deferClose > 0 {
+		tp.Debugf("heartbeat: %s, defer close: %s", sess.Id(), deferClose)
+	}
+	return deferClose
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	"github.com/henrylee2cn/goutil/coarsetime"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// GoingAwayUri the URI of the PUSH sent before the idle session is closed.
+const GoingAwayUri = "/going_away"
+
+// GoingAway the body of the PUSH sent before the idle session is closed.
+type GoingAway struct {
+	Reason string `json:"reason"`
+	// Idle the idle time in seconds.
+	Idle int64 `json:"idle"`
+}
+
+// IdleConfig the configuration of the idle timeout plugin.
+type IdleConfig struct {
+	// Timeout the session is closed after it is idle for the timeout.
+	Timeout time.Duration
+	// ExemptUris the pulls and pushes of these URI paths are not counted as the traffic, like the heartbeats.
+	ExemptUris []string
+}
+
+// NewIdleTimeout returns a plugin that closes the sessions without the traffic but the heartbeats for cfg.Timeout,
+// it sends a PUSH to GoingAwayUri before closing the session.
+func NewIdleTimeout(cfg IdleConfig) IdleTimeout {
+	if cfg.Timeout < time.Second {
+		cfg.Timeout = time.Second
+	}
+	exempt := make(map[string]bool, len(cfg.ExemptUris))
+	for _, uri := range cfg.ExemptUris {
+		exempt[uri] = true
+	}
+	return &idleTimeout{
+		timeout: cfg.Timeout,
+		exempt:  exempt,
+		wheel:   newTimingWheel(wheelTick, wheelSlots),
+	}
+}
+
+type (
+	// IdleTimeout closes the idle sessions.
+	IdleTimeout interface {
+		// Stop stops the idle timeout worker, e.g. after the peer is closed.
+		Stop()
+		// Name returns name.
+		Name() string
+		// PostNewPeer runs idle timeout woker.
+		PostNewPeer(peer tp.EarlyPeer) error
+		// PostDial initializes the idle information.
+		PostDial(sess tp.PreSession) *tp.Rerror
+		// PostAccept initializes the idle information.
+		PostAccept(sess tp.PreSession) *tp.Rerror
+		// PostWritePull updates the idle information.
+		PostWritePull(ctx tp.WriteCtx) *tp.Rerror
+		// PostWritePush updates the idle information.
+		PostWritePush(ctx tp.WriteCtx) *tp.Rerror
+		// PostReadPullHeader updates the idle information.
+		PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror
+		// PostReadPushHeader updates the idle information.
+		PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror
+	}
+	idleTimeout struct {
+		timeout time.Duration
+		exempt  map[string]bool
+		wheel   *timingWheel
+		once    sync.Once
+	}
+	// idleInfo the time of the last traffic but the heartbeats.
+	idleInfo struct {
+		last time.Time
+		mu   sync.RWMutex
+	}
+)
+
+var (
+	_ tp.PostNewPeerPlugin        = IdleTimeout(nil)
+	_ tp.PostDialPlugin           = IdleTimeout(nil)
+	_ tp.PostAcceptPlugin         = IdleTimeout(nil)
+	_ tp.PostWritePullPlugin      = IdleTimeout(nil)
+	_ tp.PostWritePushPlugin      = IdleTimeout(nil)
+	_ tp.PostReadPullHeaderPlugin = IdleTimeout(nil)
+	_ tp.PostReadPushHeaderPlugin = IdleTimeout(nil)
+)
+
+// Stop stops the idle timeout worker, e.g. after the peer is closed.
+func (i *idleTimeout) Stop() {
+	i.wheel.close()
+}
+
+// Name returns name.
+func (i *idleTimeout) Name() string {
+	return "idle-timeout"
+}
+
+// PostNewPeer runs idle timeout woker.
+func (i *idleTimeout) PostNewPeer(peer tp.EarlyPeer) error {
+	i.once.Do(func() {
+		go i.wheel.run()
+	})
+	return nil
+}
+
+// PostDial initializes the idle information.
+func (i *idleTimeout) PostDial(sess tp.PreSession) *tp.Rerror {
+	return i.PostAccept(sess)
+}
+
+// PostAccept initializes the idle information.
+func (i *idleTimeout) PostAccept(sess tp.PreSession) *tp.Rerror {
+	sess.Swap().Store(idleSwapKey, &idleInfo{last: coarsetime.CeilingTimeNow()})
+	if s, ok := sess.(tp.Session); ok {
+		i.wheel.add(func() { i.check(s) }, i.timeout)
+	}
+	return nil
+}
+
+// PostWritePull updates the idle information.
+func (i *idleTimeout) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	return i.PostWritePush(ctx)
+}
+
+// PostWritePush updates the idle information.
+func (i *idleTimeout) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	i.update(ctx, ctx.Output().UriObject().Path)
+	return nil
+}
+
+// PostReadPullHeader updates the idle information.
+func (i *idleTimeout) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	return i.PostReadPushHeader(ctx)
+}
+
+// PostReadPushHeader updates the idle information.
+func (i *idleTimeout) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	i.update(ctx, ctx.Path())
+	return nil
+}
+
+func (i *idleTimeout) update(ctx tp.PreCtx, path string) {
+	if isHeartbeatPath(path) || path == GoingAwayUri || i.exempt[path] {
+		return
+	}
+	if info, ok := getIdleInfo(ctx.Session().Swap()); ok {
+		info.mu.Lock()
+		info.last = coarsetime.CeilingTimeNow()
+		info.mu.Unlock()
+	}
+}
+
+// check closes the session if it is idle for the timeout, or schedules the next check.
+func (i *idleTimeout) check(sess tp.Session) {
+	if !sess.Health() {
+		return
+	}
+	info, ok := getIdleInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	info.mu.RLock()
+	idle := coarsetime.CeilingTimeNow().Sub(info.last)
+	info.mu.RUnlock()
+	if idle < i.timeout {
+		i.wheel.add(func() { i.check(sess) }, i.timeout-idle)
+		return
+	}
+	tp.Go(func() {
+		tp.Debugf("idle-timeout: %s, idle: %s", sess.Id(), idle)
+		sess.Push(GoingAwayUri, &GoingAway{
+			Reason: "idle timeout",
+			Idle:   int64(idle / time.Second),
+		})
+		sess.Close()
+	})
+}
+
+func getIdleInfo(m goutil.Map) (*idleInfo, bool) {
+	info, ok := m.Load(idleSwapKey)
+	if !ok {
+		return nil, false
+	}
+	return info.(*idleInfo), true
+}
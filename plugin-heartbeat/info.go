@@ -20,29 +20,53 @@ import (
 
 	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/goutil/coarsetime"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
 )
 
 type swapKey byte
 
 const (
 	heartbeatSwapKey swapKey = 0
+	pongSwapKey      swapKey = 1
+	idleSwapKey      swapKey = 2
 	minRateSecond            = 3
 )
 
+// isHeartbeatPath returns whether the URI path is the heartbeat, which is not counted as the traffic.
+func isHeartbeatPath(path string) bool {
+	return path == HeartbeatUri
+}
+
 // heartbeatInfo heartbeat info
 type heartbeatInfo struct {
 	// heartbeat rate
 	rate time.Duration
 	// last heartbeat time
 	last time.Time
-	mu   sync.RWMutex
+	// round-trip time of the PULL heartbeats
+	rtt RTT
+	// missed a heartbeat
+	suspect bool
+	// load report of the remote peer
+	remoteLoad LoadReport
+	// address passed to Dial, empty for the accepted session
+	dialAddr string
+	// protocols passed to Dial
+	protoFuncs []socket.ProtoFunc
+	// closed by the local Close, which is not redialed
+	closedLocally bool
+	// the pong has scheduled to check the session
+	pongScheduled bool
+	mu            sync.RWMutex
 }
 
 func (h *heartbeatInfo) elemCopy() heartbeatInfo {
 	h.mu.RLock()
 	copy := heartbeatInfo{
-		rate: h.rate,
-		last: h.last,
+		rate:    h.rate,
+		last:    h.last,
+		suspect: h.suspect,
 	}
 	h.mu.RUnlock()
 	return copy
@@ -61,6 +85,71 @@ func (h *heartbeatInfo) getLast() time.Time {
 	return last
 }
 
+func (h *heartbeatInfo) setRate(rate time.Duration) {
+	h.mu.Lock()
+	h.rate = rate
+	h.mu.Unlock()
+}
+
+func (h *heartbeatInfo) observeRTT(sample time.Duration) {
+	h.mu.Lock()
+	h.rtt.observe(sample)
+	h.mu.Unlock()
+}
+
+// setSuspect sets the suspect mark, and returns whether it is changed.
+func (h *heartbeatInfo) setSuspect(suspect bool) (changed bool) {
+	h.mu.Lock()
+	changed = h.suspect != suspect
+	h.suspect = suspect
+	h.mu.Unlock()
+	return
+}
+
+func (h *heartbeatInfo) setDial(addr string, protoFuncs []socket.ProtoFunc) {
+	h.mu.Lock()
+	h.dialAddr = addr
+	h.protoFuncs = protoFuncs
+	h.mu.Unlock()
+}
+
+// getDial returns the arguments of Dial, the addr is empty if the session is not redialable.
+func (h *heartbeatInfo) getDial() (addr string, protoFuncs []socket.ProtoFunc) {
+	h.mu.RLock()
+	if !h.closedLocally {
+		addr, protoFuncs = h.dialAddr, h.protoFuncs
+	}
+	h.mu.RUnlock()
+	return
+}
+
+func (h *heartbeatInfo) setClosedLocally() {
+	h.mu.Lock()
+	h.closedLocally = true
+	h.mu.Unlock()
+}
+
+// schedulePong marks the session checked by the pong, and returns false if it has been marked.
+func (h *heartbeatInfo) schedulePong() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pongScheduled {
+		return false
+	}
+	h.pongScheduled = true
+	return true
+}
+
+// SessionRate returns the heartbeat rate of the session,
+// which is the negotiated one after the first PULL heartbeat.
+func SessionRate(sess tp.BaseSession) (rate time.Duration, ok bool) {
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return 0, false
+	}
+	return info.getRate(), true
+}
+
 func initHeartbeatInfo(m goutil.Map, rate time.Duration) {
 	m.Store(heartbeatSwapKey, &heartbeatInfo{
 		rate: rate,
@@ -0,0 +1,120 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// LoadReport the load of a peer, which is carried by the heartbeats.
+type LoadReport struct {
+	// Inflight the number of the PULL handlers in progress.
+	Inflight int64 `json:"inflight"`
+	// Sessions the number of the sessions.
+	Sessions int `json:"sessions"`
+	// Goroutines the number of the goroutines.
+	Goroutines int `json:"goroutines"`
+	// Score the user-supplied load score.
+	Score float64 `json:"score"`
+	// Time the unix time in milliseconds when the report is made.
+	Time int64 `json:"time"`
+}
+
+// RemoteLoad returns the latest load report of the remote peer of the session,
+// ok is false if no report has been received.
+func RemoteLoad(sess tp.BaseSession) (report LoadReport, ok bool) {
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	info.mu.RLock()
+	report = info.remoteLoad
+	info.mu.RUnlock()
+	return report, report.Time != 0
+}
+
+type loadHolder struct {
+	enabled  bool
+	score    func() float64
+	peer     tp.BasePeer
+	inflight int64
+	mu       sync.RWMutex
+}
+
+// EnableLoadReport sends the load report with the heartbeats,
+// the score returns the user-supplied load score, which can be nil.
+func (l *loadHolder) EnableLoadReport(score func() float64) {
+	l.mu.Lock()
+	l.enabled = true
+	l.score = score
+	l.mu.Unlock()
+}
+
+func (l *loadHolder) setPeer(peer tp.BasePeer) {
+	l.mu.Lock()
+	l.peer = peer
+	l.mu.Unlock()
+}
+
+// report returns the load report of the local peer, nil if it is not enabled.
+func (l *loadHolder) report() *LoadReport {
+	l.mu.RLock()
+	enabled, score, peer := l.enabled, l.score, l.peer
+	l.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	r := &LoadReport{
+		Inflight:   atomic.LoadInt64(&l.inflight),
+		Goroutines: runtime.NumGoroutine(),
+		Time:       time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if peer != nil {
+		r.Sessions = peer.CountSession()
+	}
+	if score != nil {
+		r.Score = score()
+	}
+	return r
+}
+
+// beginHandle counts the PULL handler in progress.
+func (l *loadHolder) beginHandle() {
+	atomic.AddInt64(&l.inflight, 1)
+}
+
+// endHandle counts the PULL handler done, before the reply is written.
+func (l *loadHolder) endHandle() {
+	atomic.AddInt64(&l.inflight, -1)
+}
+
+// storeRemoteLoad stores the load report of the remote peer of the session.
+func storeRemoteLoad(sess tp.BaseSession, report *LoadReport) {
+	if report == nil || report.Time == 0 {
+		return
+	}
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	info.remoteLoad = *report
+	info.mu.Unlock()
+}
@@ -27,14 +27,17 @@ import (
 
 const (
 	// HeartbeatUri heartbeat service URI
-	HeartbeatUri      = "/heartbeat"
-	heartbeatQueryKey = "hb_"
+	HeartbeatUri = "/heartbeat"
+	// HeartbeatRateMetaKey the metadata of the PULL heartbeat reply, which is the rate negotiated by the pong.
+	HeartbeatRateMetaKey = "X-Heartbeat-Rate"
+	heartbeatQueryKey    = "hb_"
 )
 
 // NewPing returns a heartbeat(PULL or PUSH) sender plugin.
 func NewPing(rateSecond int, usePull bool) Ping {
 	p := new(heartPing)
 	p.usePull = usePull
+	p.wheel = newTimingWheel(wheelTick, wheelSlots)
 	p.SetRate(rateSecond)
 	return p
 }
@@ -43,11 +46,28 @@ type (
 	// Ping send heartbeat.
 	Ping interface {
 		// SetRate sets heartbeat rate.
+		// Note: When using PULL method, each session adopts the rate negotiated by the pong.
 		SetRate(rateSecond int)
 		// UsePull uses PULL method to ping.
 		UsePull()
 		// UsePush uses PUSH method to ping.
 		UsePush()
+		// SetHooks sets the events of the heartbeat state of the sessions.
+		// Note: The session becomes suspect when a heartbeat fails, and is declared dead when the next one fails.
+		SetHooks(hooks Hooks)
+		// Stop stops the ping worker, e.g. after the peer is closed.
+		Stop()
+		// SetReconnect redials the address of the client session whose heartbeat fails, with backoff.
+		// Note:
+		// Only the session dialed by heartbeat.Dial is redialed, when its heartbeat fails or its connection is lost,
+		// e.g. the server restarts, but not when it is closed by its Close method;
+		// Call Stop before closing the peer to stop redialing;
+		// If cfg is nil, do not reconnect.
+		SetReconnect(cfg *ReconnectConfig)
+		// EnableLoadReport sends the load report with the heartbeats, and stores the one replied,
+		// the score returns the user-supplied load score, which can be nil.
+		// Note: Only the PULL heartbeat gets the report of the remote peer.
+		EnableLoadReport(score func() float64)
 		// Name returns name.
 		Name() string
 		// PostNewPeer runs ping woker.
@@ -64,14 +84,20 @@ type (
 		PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror
 		// PostReadPushHeader updates heartbeat information.
 		PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror
+		// PreWriteReply counts the PULL handler done.
+		PreWriteReply(ctx tp.WriteCtx) *tp.Rerror
 	}
 	heartPing struct {
-		peer     tp.Peer
-		pingRate time.Duration
-		uri      string
-		usePull  bool
-		mu       sync.RWMutex
-		once     sync.Once
+		peer      tp.Peer
+		pingRate  time.Duration
+		uri       string
+		usePull   bool
+		reconnect *ReconnectConfig
+		wheel     *timingWheel
+		mu        sync.RWMutex
+		once      sync.Once
+		hooksHolder
+		loadHolder
 	}
 )
 
@@ -83,6 +109,7 @@ var (
 	_ tp.PostWritePushPlugin      = Ping(nil)
 	_ tp.PostReadPullHeaderPlugin = Ping(nil)
 	_ tp.PostReadPushHeaderPlugin = Ping(nil)
+	_ tp.PreWriteReplyPlugin      = Ping(nil)
 )
 
 // SetRate sets heartbeat rate.
@@ -129,6 +156,11 @@ func (h *heartPing) isPull() bool {
 	return h.usePull
 }
 
+// Stop stops the ping worker, e.g. after the peer is closed.
+func (h *heartPing) Stop() {
+	h.wheel.close()
+}
+
 // Name returns name.
 func (h *heartPing) Name() string {
 	return "heart-ping"
@@ -136,33 +168,10 @@ func (h *heartPing) Name() string {
 
 // PostNewPeer runs ping woker.
 func (h *heartPing) PostNewPeer(peer tp.EarlyPeer) error {
-	rangeSession := peer.RangeSession
-	go func() {
-		var isPull bool
-		for {
-			time.Sleep(h.getRate())
-			isPull = h.isPull()
-			rangeSession(func(sess tp.Session) bool {
-				if !sess.Health() {
-					return true
-				}
-				info, ok := getHeartbeatInfo(sess.Swap())
-				if !ok {
-					return true
-				}
-				cp := info.elemCopy()
-				if cp.last.Add(cp.rate).After(coarsetime.CeilingTimeNow()) {
-					return true
-				}
-				if isPull {
-					h.goPull(sess)
-				} else {
-					h.goPush(sess)
-				}
-				return true
-			})
-		}
-	}()
+	h.setPeer(peer)
+	h.once.Do(func() {
+		go h.wheel.run()
+	})
 	return nil
 }
 
@@ -175,9 +184,36 @@ func (h *heartPing) PostDial(sess tp.PreSession) *tp.Rerror {
 func (h *heartPing) PostAccept(sess tp.PreSession) *tp.Rerror {
 	rate := h.getRate()
 	initHeartbeatInfo(sess.Swap(), rate)
+	if s, ok := sess.(tp.Session); ok {
+		h.wheel.add(func() { h.check(s) }, rate)
+	}
 	return nil
 }
 
+// check pings the session if it is idle for the heartbeat rate or suspect,
+// otherwise schedules the next check.
+// The client session whose connection is lost is redialed, if the reconnect is set.
+func (h *heartPing) check(sess tp.Session) {
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	if !sess.Health() {
+		h.redial(sess, info)
+		return
+	}
+	cp := info.elemCopy()
+	if idle := coarsetime.CeilingTimeNow().Sub(cp.last); !cp.suspect && idle < cp.rate {
+		h.wheel.add(func() { h.check(sess) }, cp.rate-idle)
+		return
+	}
+	if h.isPull() {
+		h.goPull(sess, info)
+	} else {
+		h.goPush(sess, info)
+	}
+}
+
 // PostWritePull updates heartbeat information.
 func (h *heartPing) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
 	return h.PostWritePush(ctx)
@@ -191,6 +227,7 @@ func (h *heartPing) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
 
 // PostReadPullHeader updates heartbeat information.
 func (h *heartPing) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	h.beginHandle()
 	return h.PostReadPushHeader(ctx)
 }
 
@@ -200,26 +237,89 @@ func (h *heartPing) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
 	return nil
 }
 
-func (h *heartPing) goPull(sess tp.Session) {
+// PreWriteReply counts the PULL handler done.
+func (h *heartPing) PreWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	h.endHandle()
+	return nil
+}
+
+func (h *heartPing) goPull(sess tp.Session, info *heartbeatInfo) {
 	tp.Go(func() {
-		if sess.Pull(h.getUri(), nil, nil).Rerror() != nil {
-			sess.Close()
+		var (
+			report = h.report()
+			arg    interface{}
+			remote = new(LoadReport)
+			start  = time.Now()
+		)
+		if report != nil {
+			arg = report
+		}
+		pullCmd := sess.Pull(h.getUri(), arg, remote)
+		if pullCmd.Rerror() != nil {
+			h.missed(sess, info)
+			return
+		}
+		info.observeRTT(time.Since(start))
+		storeRemoteLoad(sess, remote)
+		h.fireRecover(sess, info)
+		rate := h.getRate()
+		if meta := pullCmd.InputMeta(); meta != nil {
+			if rateSecond := parseHeartbeatRateSecond(string(meta.Peek(HeartbeatRateMetaKey))); rateSecond > 0 {
+				rate = time.Second * time.Duration(rateSecond)
+			}
 		}
+		h.adopt(sess, info, rate)
 	})
 }
 
-func (h *heartPing) goPush(sess tp.Session) {
+func (h *heartPing) goPush(sess tp.Session, info *heartbeatInfo) {
 	tp.Go(func() {
-		if sess.Push(h.getUri(), nil) != nil {
-			sess.Close()
+		var arg interface{}
+		if report := h.report(); report != nil {
+			arg = report
 		}
+		if sess.Push(h.getUri(), arg) != nil {
+			h.missed(sess, info)
+			return
+		}
+		h.fireRecover(sess, info)
+		h.adopt(sess, info, h.getRate())
 	})
 }
 
+// adopt sets the heartbeat rate of the session, and schedules the next check.
+func (h *heartPing) adopt(sess tp.Session, info *heartbeatInfo, rate time.Duration) {
+	if info.getRate() != rate {
+		info.setRate(rate)
+		tp.Debugf("heart-ping: %s, adopt rate: %s", sess.Id(), rate)
+	}
+	h.wheel.add(func() { h.check(sess) }, rate)
+}
+
+// missed handles the failed heartbeat, the session becomes suspect at the first time,
+// and is closed at the second time unless OnTimeout defers it.
+// The client session is redialed after it is closed, if the reconnect is set.
+func (h *heartPing) missed(sess tp.Session, info *heartbeatInfo) {
+	if !sess.Health() {
+		// the connection is lost
+		h.redial(sess, info)
+		return
+	}
+	next := info.getRate()
+	if !info.elemCopy().suspect {
+		h.fireSuspect(sess, info)
+	} else if next = h.fireTimeout(sess, info); next <= 0 {
+		sess.Close()
+		h.redial(sess, info)
+		return
+	}
+	h.wheel.add(func() { h.check(sess) }, next)
+}
+
 func (h *heartPing) update(ctx tp.PreCtx) {
 	sess := ctx.Session()
 	if !sess.Health() {
 		return
 	}
-	updateHeartbeatInfo(sess.Swap(), h.getRate())
+	updateHeartbeatInfo(sess.Swap(), 0)
 }
@@ -17,20 +17,38 @@ package heartbeat
 import (
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/goutil/coarsetime"
 	tp "github.com/henrylee2cn/teleport"
 )
 
 // NewPong returns a heartbeat receiver plugin.
 func NewPong() Pong {
-	return new(heartPong)
+	return &heartPong{
+		wheel: newTimingWheel(wheelTick, wheelSlots),
+	}
 }
 
 type (
 	// Pong receive heartbeat.
 	Pong interface {
+		// SetRateRange sets the range of the heartbeat rate that the pong accepts,
+		// the rate out of the range is replaced by the nearest bound, 0 means no bound.
+		SetRateRange(minSecond, maxSecond int)
+		// SetRatePolicy sets the policy that decides the heartbeat rate of the session,
+		// before the rate range is applied.
+		SetRatePolicy(policy RatePolicy)
+		// SetHooks sets the events of the heartbeat state of the sessions.
+		// Note: The session becomes suspect when it is idle for the heartbeat rate, and is declared dead for twice the rate.
+		SetHooks(hooks Hooks)
+		// Stop stops the pong worker, e.g. after the peer is closed.
+		Stop()
+		// EnableLoadReport replies the load report to the heartbeats that carry a report,
+		// the score returns the user-supplied load score, which can be nil.
+		EnableLoadReport(score func() float64)
 		// Name returns name.
 		Name() string
 		// PostNewPeer runs ping woker.
@@ -43,8 +61,22 @@ type (
 		PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror
 		// PostReadPushHeader updates heartbeat information.
 		PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror
+		// PreWriteReply counts the PULL handler done.
+		PreWriteReply(ctx tp.WriteCtx) *tp.Rerror
+	}
+	// RatePolicy returns the heartbeat rate that the pong wants for the session,
+	// e.g. a slower one under load, the rateSecond is the one requested by the ping.
+	RatePolicy func(sess tp.Session, rateSecond int) int
+	heartPong  struct {
+		minRateSecond int
+		maxRateSecond int
+		policy        RatePolicy
+		wheel         *timingWheel
+		mu            sync.RWMutex
+		once          sync.Once
+		hooksHolder
+		loadHolder
 	}
-	heartPong struct{}
 )
 
 var (
@@ -53,8 +85,54 @@ var (
 	_ tp.PostWritePushPlugin      = Pong(nil)
 	_ tp.PostReadPullHeaderPlugin = Pong(nil)
 	_ tp.PostReadPushHeaderPlugin = Pong(nil)
+	_ tp.PreWriteReplyPlugin      = Pong(nil)
 )
 
+// SetRateRange sets the range of the heartbeat rate that the pong accepts,
+// the rate out of the range is replaced by the nearest bound, 0 means no bound.
+func (h *heartPong) SetRateRange(minSecond, maxSecond int) {
+	h.mu.Lock()
+	h.minRateSecond = minSecond
+	h.maxRateSecond = maxSecond
+	h.mu.Unlock()
+}
+
+// SetRatePolicy sets the policy that decides the heartbeat rate of the session,
+// before the rate range is applied.
+func (h *heartPong) SetRatePolicy(policy RatePolicy) {
+	h.mu.Lock()
+	h.policy = policy
+	h.mu.Unlock()
+}
+
+// negotiate returns the heartbeat rate that the pong accepts for the rate requested.
+func (h *heartPong) negotiate(sess tp.Session, rateSecond int) int {
+	h.mu.RLock()
+	policy := h.policy
+	h.mu.RUnlock()
+	if policy != nil {
+		rateSecond = policy(sess, rateSecond)
+	}
+	return h.clamp(rateSecond)
+}
+
+// clamp returns the nearest rate in the range.
+func (h *heartPong) clamp(rateSecond int) int {
+	h.mu.RLock()
+	minSecond, maxSecond := h.minRateSecond, h.maxRateSecond
+	h.mu.RUnlock()
+	if minSecond > 0 && rateSecond < minSecond {
+		rateSecond = minSecond
+	}
+	if maxSecond > 0 && rateSecond > maxSecond {
+		rateSecond = maxSecond
+	}
+	if rateSecond < minRateSecond {
+		rateSecond = minRateSecond
+	}
+	return rateSecond
+}
+
 func (h *heartPong) Name() string {
 	return "heart-pong"
 }
@@ -62,41 +140,76 @@ func (h *heartPong) Name() string {
 func (h *heartPong) PostNewPeer(peer tp.EarlyPeer) error {
 	peer.RoutePullFunc((*pongPull).heartbeat)
 	peer.RoutePushFunc((*pongPush).heartbeat)
-	rangeSession := peer.RangeSession
-	const initial = time.Second*minRateSecond - 1
-	interval := initial
-	go func() {
-		for {
-			time.Sleep(interval)
-			rangeSession(func(sess tp.Session) bool {
-				info, ok := getHeartbeatInfo(sess.Swap())
-				if !ok {
-					return true
-				}
-				cp := info.elemCopy()
-				if sess.Health() && cp.last.Add(cp.rate*2).Before(coarsetime.CeilingTimeNow()) {
-					sess.Close()
-				}
-				if cp.rate < interval || interval == initial {
-					interval = cp.rate
-				}
-				return true
-			})
-		}
-	}()
+	h.setPeer(peer)
+	h.once.Do(func() {
+		go h.wheel.run()
+	})
 	return nil
 }
 
+// Stop stops the pong worker, e.g. after the peer is closed.
+func (h *heartPong) Stop() {
+	h.wheel.close()
+}
+
+// check marks the session suspect if it is idle for the heartbeat rate,
+// closes it if it is idle for twice the rate, and schedules the next check.
+// Only the marks are updated in the wheel, the hooks and the close are run in other goroutines.
+func (h *heartPong) check(sess tp.Session) {
+	if !sess.Health() {
+		return
+	}
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	cp := info.elemCopy()
+	next := func() { h.check(sess) }
+	idle := coarsetime.CeilingTimeNow().Sub(cp.last)
+	switch {
+	case idle < cp.rate:
+		if info.setSuspect(false) {
+			tp.Go(func() { h.onRecover(sess) })
+		}
+		h.wheel.add(next, cp.rate-idle)
+	case idle <= cp.rate*2:
+		if info.setSuspect(true) {
+			tp.Go(func() { h.onSuspect(sess, info) })
+		}
+		h.wheel.add(next, cp.rate*2-idle)
+	default:
+		tp.Go(func() {
+			if deferClose := h.fireTimeout(sess, info); deferClose > 0 {
+				h.wheel.add(next, deferClose)
+				return
+			}
+			sess.Close()
+		})
+	}
+}
+
 func (h *heartPong) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	h.beginHandle()
+	if isHeartbeatPath(ctx.Path()) {
+		ctx.Swap().Store(pongSwapKey, h)
+	}
 	h.update(ctx)
 	return nil
 }
 
 func (h *heartPong) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	if isHeartbeatPath(ctx.Path()) {
+		ctx.Swap().Store(pongSwapKey, h)
+	}
 	h.update(ctx)
 	return nil
 }
 
+func (h *heartPong) PreWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	h.endHandle()
+	return nil
+}
+
 func (h *heartPong) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
 	return h.PostWritePush(ctx)
 }
@@ -111,7 +224,7 @@ func (h *heartPong) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
 }
 
 func (h *heartPong) update(ctx tp.ReadCtx) {
-	if ctx.Path() == HeartbeatUri {
+	if isHeartbeatPath(ctx.Path()) {
 		return
 	}
 	sess := ctx.Session()
@@ -125,31 +238,74 @@ type pongPull struct {
 	tp.PullCtx
 }
 
-func (ctx *pongPull) heartbeat(_ *struct{}) (*struct{}, *tp.Rerror) {
-	return nil, handelHeartbeat(ctx.Session(), ctx.Query())
+// heartbeat the ping carries its load report optionally, and the pong replies its own one if so.
+func (ctx *pongPull) heartbeat(remote *LoadReport) (*LoadReport, *tp.Rerror) {
+	pong := getPong(ctx.Swap())
+	rateSecond, rerr := handelHeartbeat(ctx.Session(), ctx.Query(), pong, true)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if rateSecond > 0 {
+		ctx.SetMeta(HeartbeatRateMetaKey, strconv.Itoa(rateSecond))
+	}
+	storeRemoteLoad(ctx.Session(), remote)
+	if remote.Time == 0 || pong == nil {
+		return nil, nil
+	}
+	return pong.report(), nil
 }
 
 type pongPush struct {
 	tp.PushCtx
 }
 
-func (ctx *pongPush) heartbeat(_ *struct{}) *tp.Rerror {
-	return handelHeartbeat(ctx.Session(), ctx.Query())
+// heartbeat the PUSH heartbeat can not reply the negotiated rate, so the rate requested is only clamped to the range.
+func (ctx *pongPush) heartbeat(remote *LoadReport) *tp.Rerror {
+	_, rerr := handelHeartbeat(ctx.Session(), ctx.Query(), getPong(ctx.Swap()), false)
+	if rerr == nil {
+		storeRemoteLoad(ctx.Session(), remote)
+	}
+	return rerr
+}
+
+func getPong(m goutil.Map) *heartPong {
+	pong, ok := m.Load(pongSwapKey)
+	if !ok {
+		return nil
+	}
+	return pong.(*heartPong)
 }
 
-func handelHeartbeat(sess tp.Session, query url.Values) *tp.Rerror {
+// handelHeartbeat updates the heartbeat info, and returns the rate accepted,
+// the rate requested is negotiated if negotiate is true, otherwise clamped to the range.
+// The pong starts to check the session after the first heartbeat.
+func handelHeartbeat(sess tp.Session, query url.Values, pong *heartPong, negotiate bool) (int, *tp.Rerror) {
 	rateStr := query.Get(heartbeatQueryKey)
 	rateSecond := parseHeartbeatRateSecond(rateStr)
-	isFirst := updateHeartbeatInfo(sess.Swap(), time.Second*time.Duration(rateSecond))
+	if rateSecond > 0 && pong != nil {
+		if negotiate {
+			rateSecond = pong.negotiate(sess, rateSecond)
+		} else {
+			rateSecond = pong.clamp(rateSecond)
+		}
+	}
+	rate := time.Second * time.Duration(rateSecond)
+	isFirst := updateHeartbeatInfo(sess.Swap(), rate)
 	if isFirst && rateSecond == -1 {
-		return tp.NewRerror(tp.CodeBadPacket, "Invalid Heartbeat Rate", rateStr)
+		return 0, tp.NewRerror(tp.CodeBadPacket, "Invalid Heartbeat Rate", rateStr)
 	}
-	if rateSecond == 0 {
+	// the info may be created by the ping of the same peer, so the check is scheduled once by the mark.
+	if rate > 0 && pong != nil {
+		if info, ok := getHeartbeatInfo(sess.Swap()); ok && info.schedulePong() {
+			pong.wheel.add(func() { pong.check(sess) }, rate)
+		}
+	}
+	if rateSecond <= 0 {
 		tp.Tracef("heart-pong: %s", sess.Id())
 	} else {
 		tp.Tracef("heart-pong: %s, set rate: %ds", sess.Id(), rateSecond)
 	}
-	return nil
+	return rateSecond, nil
 }
 
 func parseHeartbeatRateSecond(s string) int {
@@ -0,0 +1,170 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// ReconnectConfig the configuration of redialing the client session whose heartbeat fails.
+type ReconnectConfig struct {
+	// InitialBackoff the delay before the first attempt, default 1s.
+	InitialBackoff time.Duration
+	// MaxBackoff the maximum delay between the attempts, which doubles after each failure, default 1min.
+	MaxBackoff time.Duration
+	// MaxAttempts the maximum number of the attempts, 0 means no limit.
+	MaxAttempts int
+	// PostDial is called with the new session after the PostDial plugins of the peer,
+	// e.g. to subscribe again, the session is closed and redialed if it returns an error.
+	PostDial func(sess tp.Session) *tp.Rerror
+	// OnEvent is called after each attempt.
+	OnEvent func(event ReconnectEvent)
+}
+
+// ReconnectEvent the result of a reconnect attempt.
+type ReconnectEvent struct {
+	// Addr the address passed to Dial.
+	Addr string
+	// Attempt the sequence number of the attempt, starting from 1.
+	Attempt int
+	// Session the new session, which is redialable as the one returned by Dial, nil if the attempt fails.
+	Session tp.Session
+	// Rerror the error of the attempt.
+	Rerror *tp.Rerror
+	// GaveUp is true if the attempts are exhausted.
+	GaveUp bool
+}
+
+func (r *ReconnectConfig) normalize() *ReconnectConfig {
+	c := *r
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = time.Second
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = time.Minute
+		if c.MaxBackoff < c.InitialBackoff {
+			c.MaxBackoff = c.InitialBackoff
+		}
+	}
+	return &c
+}
+
+// Dial dials the addr by the peer that the ping is registered to,
+// and the session is redialed with the same arguments when its heartbeat fails, if the reconnect is set.
+// Note: Closing the returned session by its Close method stops redialing it.
+func Dial(peer tp.Peer, addr string, protoFunc ...socket.ProtoFunc) (tp.Session, *tp.Rerror) {
+	sess, rerr := peer.Dial(addr, protoFunc...)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return redialable(sess, addr, protoFunc), nil
+}
+
+// redialable records the arguments of Dial, and wraps the session to mark its local Close.
+func redialable(sess tp.Session, addr string, protoFuncs []socket.ProtoFunc) tp.Session {
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		// the ping is not registered
+		return sess
+	}
+	info.setDial(addr, protoFuncs)
+	return &dialedSession{Session: sess, info: info}
+}
+
+// dialedSession the session dialed by Dial.
+type dialedSession struct {
+	tp.Session
+	info *heartbeatInfo
+}
+
+// Close closes the session, which is not redialed any more.
+func (d *dialedSession) Close() error {
+	d.info.setClosedLocally()
+	return d.Session.Close()
+}
+
+// SetReconnect redials the address of the client session whose heartbeat fails, with backoff.
+// Note:
+// Only the session dialed by heartbeat.Dial is redialed, when its heartbeat fails or its connection is lost,
+// e.g. the server restarts, but not when it is closed by its Close method;
+// Call Stop before closing the peer to stop redialing;
+// If cfg is nil, do not reconnect.
+func (h *heartPing) SetReconnect(cfg *ReconnectConfig) {
+	if cfg != nil {
+		cfg = cfg.normalize()
+	}
+	h.mu.Lock()
+	h.reconnect = cfg
+	h.mu.Unlock()
+}
+
+func (h *heartPing) getReconnect() *ReconnectConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.reconnect
+}
+
+// redial dials the address of the dead client session again, until it succeeds or the attempts are exhausted.
+// The session that is not dialed by Dial, or is closed locally, is not redialed.
+func (h *heartPing) redial(sess tp.Session, info *heartbeatInfo) {
+	cfg := h.getReconnect()
+	addr, protoFuncs := info.getDial()
+	if cfg == nil || addr == "" {
+		return
+	}
+	peer := sess.Peer()
+	tp.Go(func() {
+		backoff := cfg.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-h.wheel.stop:
+				timer.Stop()
+				return
+			}
+			event := ReconnectEvent{Addr: addr, Attempt: attempt}
+			newSess, rerr := peer.Dial(addr, protoFuncs...)
+			if rerr == nil {
+				newSess = redialable(newSess, addr, protoFuncs)
+			}
+			if rerr == nil && cfg.PostDial != nil {
+				if rerr = cfg.PostDial(newSess); rerr != nil {
+					newSess.Close()
+				}
+			}
+			if rerr == nil {
+				event.Session = newSess
+				tp.Infof("heart-ping: reconnected to %s, attempt: %d", addr, attempt)
+			} else {
+				event.Rerror = rerr
+				event.GaveUp = cfg.MaxAttempts > 0 && attempt >= cfg.MaxAttempts
+				tp.Warnf("heart-ping: reconnect to %s, attempt: %d, error: %s", addr, attempt, rerr.Message)
+			}
+			if cfg.OnEvent != nil {
+				cfg.OnEvent(event)
+			}
+			if rerr == nil || event.GaveUp {
+				return
+			}
+			if backoff *= 2; backoff > cfg.MaxBackoff {
+				backoff = cfg.MaxBackoff
+			}
+		}
+	})
+}
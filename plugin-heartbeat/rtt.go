@@ -0,0 +1,63 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// RTT the round-trip time of the PULL heartbeats of a session.
+type RTT struct {
+	// Last the latest round-trip time.
+	Last time.Duration
+	// Average the smoothed round-trip time.
+	Average time.Duration
+	// Jitter the smoothed mean deviation of the round-trip time.
+	Jitter time.Duration
+	// Samples the number of the heartbeats measured.
+	Samples uint64
+}
+
+// SessionRTT returns the round-trip time of the session measured by the PULL heartbeats,
+// ok is false if no heartbeat has been measured.
+func SessionRTT(sess tp.BaseSession) (rtt RTT, ok bool) {
+	info, ok := getHeartbeatInfo(sess.Swap())
+	if !ok {
+		return
+	}
+	info.mu.RLock()
+	rtt = info.rtt
+	info.mu.RUnlock()
+	return rtt, rtt.Samples > 0
+}
+
+// observe updates the RTT with a sample, like the TCP retransmission timer(RFC 6298).
+func (r *RTT) observe(sample time.Duration) {
+	r.Last = sample
+	r.Samples++
+	if r.Samples == 1 {
+		r.Average = sample
+		r.Jitter = sample / 2
+		return
+	}
+	delta := r.Average - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	r.Jitter = (r.Jitter*3 + delta) / 4
+	r.Average = (r.Average*7 + sample) / 8
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	wheelTick  = time.Millisecond * 100
+	wheelSlots = 512
+)
+
+type (
+	// timingWheel the hashed timing wheel, which runs each task once after its delay,
+	// the cost of a tick is proportional to the tasks in the slot, not all the tasks.
+	timingWheel struct {
+		tick  time.Duration
+		slots []*list.List
+		pos   int
+		stop  chan struct{}
+		once  sync.Once
+		mu    sync.Mutex
+	}
+	wheelTask struct {
+		fn     func()
+		rounds int
+	}
+)
+
+func newTimingWheel(tick time.Duration, slots int) *timingWheel {
+	w := &timingWheel{
+		tick:  tick,
+		slots: make([]*list.List, slots),
+		stop:  make(chan struct{}),
+	}
+	for i := range w.slots {
+		w.slots[i] = list.New()
+	}
+	return w
+}
+
+// run advances the wheel every tick, until it is closed.
+func (w *timingWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.advance()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close stops the wheel and drops the tasks.
+func (w *timingWheel) close() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	w.mu.Lock()
+	for _, slot := range w.slots {
+		slot.Init()
+	}
+	w.mu.Unlock()
+}
+
+// add schedules the fn to run once after d, in the goroutine of the wheel.
+func (w *timingWheel) add(fn func(), d time.Duration) {
+	select {
+	case <-w.stop:
+		return
+	default:
+	}
+	t := &wheelTask{fn: fn}
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	n := len(w.slots)
+	w.mu.Lock()
+	t.rounds = (ticks - 1) / n
+	w.slots[(w.pos+ticks)%n].PushBack(t)
+	w.mu.Unlock()
+}
+
+// advance moves to the next slot and runs its expired tasks.
+func (w *timingWheel) advance() {
+	var expired []*wheelTask
+	w.mu.Lock()
+	w.pos = (w.pos + 1) % len(w.slots)
+	slot := w.slots[w.pos]
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*wheelTask)
+		if t.rounds > 0 {
+			t.rounds--
+		} else {
+			slot.Remove(e)
+			expired = append(expired, t)
+		}
+		e = next
+	}
+	w.mu.Unlock()
+	for _, t := range expired {
+		t.fn()
+	}
+}
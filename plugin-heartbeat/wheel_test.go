@@ -0,0 +1,97 @@
+package heartbeat
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	"github.com/henrylee2cn/goutil/coarsetime"
+)
+
+func TestTimingWheel(t *testing.T) {
+	w := newTimingWheel(time.Millisecond, 8)
+	var (
+		fired []int
+		mu    sync.Mutex
+	)
+	for _, ticks := range []int{20, 1, 8, 3} {
+		ticks := ticks
+		w.add(func() {
+			mu.Lock()
+			fired = append(fired, ticks)
+			mu.Unlock()
+		}, time.Millisecond*time.Duration(ticks))
+	}
+	for i := 0; i < 20; i++ {
+		w.advance()
+	}
+	expect := []int{1, 3, 8, 20}
+	if len(fired) != len(expect) {
+		t.Fatalf("expect %v, but get %v", expect, fired)
+	}
+	for i := range expect {
+		if fired[i] != expect[i] {
+			t.Fatalf("expect %v, but get %v", expect, fired)
+		}
+	}
+}
+
+// benchmarkSessions creates the heartbeat info of n sessions with the rate 3s.
+func benchmarkSessions(n int) []goutil.Map {
+	swaps := make([]goutil.Map, n)
+	for i := range swaps {
+		swaps[i] = goutil.AtomicMap()
+		initHeartbeatInfo(swaps[i], time.Second*minRateSecond)
+	}
+	return swaps
+}
+
+// BenchmarkTimingWheel each op is a tick of the wheel, which checks only the sessions due.
+func BenchmarkTimingWheel(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			w := newTimingWheel(wheelTick, wheelSlots)
+			for i, swap := range benchmarkSessions(n) {
+				swap := swap
+				var check func()
+				check = func() {
+					info, _ := getHeartbeatInfo(swap)
+					cp := info.elemCopy()
+					w.add(check, cp.rate)
+				}
+				// spread the sessions over the heartbeat rate.
+				w.add(check, time.Second*minRateSecond*time.Duration(i)/time.Duration(n))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.advance()
+			}
+		})
+	}
+}
+
+// BenchmarkRangeSession each op is a tick of the previous worker, which checks all the sessions.
+func BenchmarkRangeSession(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			swaps := benchmarkSessions(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			var due int
+			for i := 0; i < b.N; i++ {
+				now := coarsetime.CeilingTimeNow()
+				for _, swap := range swaps {
+					info, _ := getHeartbeatInfo(swap)
+					cp := info.elemCopy()
+					if !cp.last.Add(cp.rate).After(now) {
+						due++
+					}
+				}
+			}
+			_ = due
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/henrylee2cn/goutil"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// AES_GCM the AEAD algorithm AES-GCM, whose cipherkey is 16, 24, or 32 bytes.
+	AES_GCM = "aes-gcm"
+	// CHACHA20_POLY1305 the AEAD algorithm ChaCha20-Poly1305, whose cipherkey is 32 bytes.
+	CHACHA20_POLY1305 = "chacha20-poly1305"
+)
+
+// secureKey a cipherkey and its version, with the AEAD ciphers it supports.
+// The AEAD ciphers use the subkeys derived from the cipherkey,
+// and the cipherkey itself is only used by the AES without authentication, for the compatibility.
+type secureKey struct {
+	packets   int64 // atomic, the first for the 64-bit alignment
+	lastSeen  int64 // atomic, unix nano
+	version   string
+	cipherkey []byte
+	aeads     map[string]cipher.AEAD
+}
+
+func newSecureKey(cipherkey []byte) (*secureKey, error) {
+	if _, err := aes.NewCipher(cipherkey); err != nil {
+		return nil, err
+	}
+	gcmKey, err := deriveKey(cipherkey, AES_GCM, len(cipherkey))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(gcmKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &secureKey{
+		version:   goutil.Md5(cipherkey),
+		cipherkey: cipherkey,
+		aeads:     map[string]cipher.AEAD{AES_GCM: gcm},
+	}
+	if len(cipherkey) == chacha20poly1305.KeySize {
+		chachaKey, err := deriveKey(cipherkey, CHACHA20_POLY1305, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		if k.aeads[CHACHA20_POLY1305], err = chacha20poly1305.New(chachaKey); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// deriveKey derives the subkey of the algorithm from the cipherkey by HKDF-SHA256,
+// so that the algorithms never share a key.
+func deriveKey(cipherkey []byte, algorithm string, size int) ([]byte, error) {
+	subkey := make([]byte, size)
+	r := hkdf.New(sha256.New, cipherkey, nil, []byte("tp-ext/plugin-secure "+algorithm))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// supports returns whether the algorithm is available for the cipherkey,
+// the empty algorithm means AES without authentication.
+func (k *secureKey) supports(algorithm string) bool {
+	if len(algorithm) == 0 {
+		return true
+	}
+	_, ok := k.aeads[algorithm]
+	return ok
+}
+
+// encrypt encrypts the plaintext, the AEAD ciphertext is the base64 of nonce||sealed.
+func (k *secureKey) encrypt(algorithm string, plaintext, aad []byte) ([]byte, error) {
+	if len(algorithm) == 0 {
+		return goutil.AESEncrypt(k.cipherkey, plaintext), nil
+	}
+	aead, ok := k.aeads[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, aad)
+	ciphertext := make([]byte, base64.RawURLEncoding.EncodedLen(len(sealed)))
+	base64.RawURLEncoding.Encode(ciphertext, sealed)
+	return ciphertext, nil
+}
+
+// decrypt decrypts the ciphertext, the AEAD one fails if it or the aad is tampered.
+func (k *secureKey) decrypt(algorithm string, ciphertext, aad []byte) ([]byte, error) {
+	if len(algorithm) == 0 {
+		return goutil.AESDecrypt(k.cipherkey, ciphertext)
+	}
+	aead, ok := k.aeads[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	sealed := make([]byte, base64.RawURLEncoding.DecodedLen(len(ciphertext)))
+	n, err := base64.RawURLEncoding.Decode(sealed, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[:n]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// additionalData returns the AEAD additional data, which binds the ciphertext
+// to the packet seq, URI path and type, and the part(query or body) of the packet.
+func additionalData(seq string, path string, ptype byte, part string) []byte {
+	return []byte(seq + "\n" + path + "\n" + strconv.Itoa(int(ptype)) + "\n" + part)
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secure
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/goutil/coarsetime"
+)
+
+type (
+	// Keyring the cipherkeys of the secure plugin, which can be added and retired at runtime.
+	// The newest cipherkey encrypts, and any of them decrypts.
+	// Note: It should be created by NewKeyring.
+	Keyring struct {
+		keys       []*secureKey    // the oldest first
+		algorithms map[string]bool // the algorithms of the plugins, which the newest cipherkey should support
+		mu         sync.RWMutex
+	}
+	// KeyUsage the statistics of the cipherkey version seen in the received packets.
+	KeyUsage struct {
+		Version string
+		// Packets the number of the received packets whose query or body is encrypted by the version.
+		Packets int64
+		// LastSeen the time of the last received packet encrypted by the version, zero if never.
+		LastSeen time.Time
+	}
+)
+
+// NewKeyring creates a keyring of the cipherkeys, the last one is the newest.
+// Each cipherkey should be the AES key, either 16, 24, or 32 bytes.
+func NewKeyring(cipherkey ...string) (*Keyring, error) {
+	if len(cipherkey) == 0 {
+		return nil, errors.New("secure: empty keyring")
+	}
+	k := new(Keyring)
+	for _, c := range cipherkey {
+		if _, err := k.Add(c); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add adds the cipherkey as the newest one, which encrypts the subsequent packets, and returns its version.
+// Note: For the rolling rotation, Accept the cipherkey on all the peers first, then Add it;
+// It fails if the cipherkey does not support the algorithm of the plugins using the keyring.
+func (k *Keyring) Add(cipherkey string) (version string, err error) {
+	return k.add(cipherkey, true)
+}
+
+// Accept adds the cipherkey only to decrypt, as the oldest one, and returns its version.
+// If the cipherkey exists, it is not changed.
+func (k *Keyring) Accept(cipherkey string) (version string, err error) {
+	return k.add(cipherkey, false)
+}
+
+func (k *Keyring) add(cipherkey string, newest bool) (string, error) {
+	key, err := newSecureKey([]byte(cipherkey))
+	if err != nil {
+		return "", fmt.Errorf("secure: %v", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if newest {
+		if err = k.checkNewest(key); err != nil {
+			return "", err
+		}
+	}
+	for i, old := range k.keys {
+		if old.version != key.version {
+			continue
+		}
+		if !newest {
+			return old.version, nil
+		}
+		// promotes the existing one, keeping its statistics.
+		key = old
+		k.keys = append(k.keys[:i], k.keys[i+1:]...)
+		break
+	}
+	if newest {
+		k.keys = append(k.keys, key)
+	} else {
+		k.keys = append([]*secureKey{key}, k.keys...)
+	}
+	return key.version, nil
+}
+
+// Retire removes the cipherkey of the version, whose packets can not be decrypted any more.
+// Note: The last cipherkey can not be retired,
+// neither can the newest one if the next newest does not support the algorithm of the plugins using the keyring.
+func (k *Keyring) Retire(version string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, key := range k.keys {
+		if key.version != version {
+			continue
+		}
+		if len(k.keys) == 1 {
+			return errors.New("secure: can not retire the last cipherkey")
+		}
+		if i == len(k.keys)-1 {
+			if err := k.checkNewest(k.keys[i-1]); err != nil {
+				return err
+			}
+		}
+		k.keys = append(k.keys[:i], k.keys[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("secure: unknown cipherkey version %q", version)
+}
+
+// Current returns the version of the newest cipherkey, which encrypts.
+func (k *Keyring) Current() string {
+	return k.current().version
+}
+
+// Versions returns the versions of the cipherkeys, the oldest first.
+func (k *Keyring) Versions() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	versions := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		versions[i] = key.version
+	}
+	return versions
+}
+
+// Seen returns the usage of the cipherkeys in the received packets, the oldest first.
+// The cipherkey that is not seen for a while can be retired safely.
+func (k *Keyring) Seen() []KeyUsage {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	usages := make([]KeyUsage, len(k.keys))
+	for i, key := range k.keys {
+		usages[i] = KeyUsage{
+			Version: key.version,
+			Packets: atomic.LoadInt64(&key.packets),
+		}
+		if nano := atomic.LoadInt64(&key.lastSeen); nano > 0 {
+			usages[i].LastSeen = time.Unix(0, nano)
+		}
+	}
+	return usages
+}
+
+func (k *Keyring) current() *secureKey {
+	k.mu.RLock()
+	key := k.keys[len(k.keys)-1]
+	k.mu.RUnlock()
+	return key
+}
+
+// require makes the newest cipherkey always support the algorithm.
+func (k *Keyring) require(algorithm string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.keys[len(k.keys)-1].supports(algorithm) {
+		return fmt.Errorf("secure: unsupported algorithm %q for the newest cipherkey", algorithm)
+	}
+	if k.algorithms == nil {
+		k.algorithms = make(map[string]bool)
+	}
+	k.algorithms[algorithm] = true
+	return nil
+}
+
+// checkNewest returns an error if the cipherkey to be the newest does not support the required algorithms.
+// Note: The caller should hold the lock.
+func (k *Keyring) checkNewest(key *secureKey) error {
+	for algorithm := range k.algorithms {
+		if !key.supports(algorithm) {
+			return fmt.Errorf("secure: the cipherkey of version %q does not support the algorithm %q", key.version, algorithm)
+		}
+	}
+	return nil
+}
+
+// lookup returns the cipherkey of the version.
+func (k *Keyring) lookup(version string) (*secureKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if key := k.keys[i]; key.version == version {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// seen counts the received packet encrypted by the cipherkey.
+func (key *secureKey) seen() {
+	atomic.AddInt64(&key.packets, 1)
+	atomic.StoreInt64(&key.lastSeen, coarsetime.CeilingTimeNow().UnixNano())
+}
@@ -16,7 +16,6 @@
 package secure
 
 import (
-	"crypto/aes"
 	"fmt"
 	"net/url"
 
@@ -38,31 +37,100 @@ const (
 	CIPHERVERSION_KEY = "cipherversion"
 	// CIPHERTEXT_KEY ciphertext content
 	CIPHERTEXT_KEY = "ciphertext"
+	// CIPHERALGORITHM_KEY cipher algorithm, empty means AES without authentication
+	CIPHERALGORITHM_KEY = "cipheralgorithm"
 )
 
 // NewSecurePlugin creates a AES encryption/decryption plugin.
 // The cipherkey argument should be the AES key,
 // either 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256.
 func NewSecurePlugin(rerrCode int32, cipherkey string) tp.Plugin {
-	b := []byte(cipherkey)
-	if _, err := aes.NewCipher(b); err != nil {
-		tp.Fatalf("NewSecurePlugin: %v", err)
+	return newSecurePlugin("NewSecurePlugin", rerrCode, "", cipherkey, false)
+}
+
+// NewAEADPlugin creates an authenticated encryption/decryption plugin.
+// The algorithm argument should be AES_GCM or CHACHA20_POLY1305,
+// and the cipherkey argument should be the AES key (16, 24, or 32 bytes), or the 32 bytes ChaCha20-Poly1305 key.
+// The ciphertext is bound to the packet seq, URI path and type, so the tampered or moved one is rejected,
+// and so is the secure packet without the ciphertext.
+// Note: The packet that is not marked by SECURE_META_KEY is accepted in plaintext, see NewRequireSecurePlugin.
+// The ciphertext of the other algorithms is rejected, unless acceptLegacy is true for the migration,
+// then the ciphertext of NewSecurePlugin with the same cipherkey is accepted, and its PULL is replied in the same way.
+func NewAEADPlugin(rerrCode int32, algorithm string, cipherkey string, acceptLegacy bool) tp.Plugin {
+	if len(algorithm) == 0 {
+		tp.Fatalf("NewAEADPlugin: empty algorithm")
+	}
+	return newSecurePlugin("NewAEADPlugin", rerrCode, algorithm, cipherkey, acceptLegacy)
+}
+
+// NewKeyringPlugin creates an encryption/decryption plugin with the cipherkeys of the keyring,
+// the newest cipherkey encrypts, and any of them decrypts.
+// The algorithm argument should be AES_GCM, CHACHA20_POLY1305, or empty for the AES without authentication.
+// The acceptLegacy argument is the same as NewAEADPlugin.
+// Note: The newest cipherkey should support the algorithm,
+// so that the keyring refuses to Add or Retire the cipherkey which breaks it.
+func NewKeyringPlugin(rerrCode int32, algorithm string, keyring *Keyring, acceptLegacy bool) tp.Plugin {
+	if err := keyring.require(algorithm); err != nil {
+		tp.Fatalf("NewKeyringPlugin: %v", err)
 	}
-	version := goutil.Md5([]byte(cipherkey))
 	return &securePlugin{
 		encryptPlugin: &encryptPlugin{
-			version:   version,
-			cipherkey: b,
-			rerrCode:  rerrCode,
+			keyring:      keyring,
+			algorithm:    algorithm,
+			acceptLegacy: acceptLegacy,
+			rerrCode:     rerrCode,
 		},
 		decryptPlugin: &decryptPlugin{
-			version:   version,
-			cipherkey: b,
-			rerrCode:  rerrCode,
+			keyring:      keyring,
+			algorithm:    algorithm,
+			acceptLegacy: acceptLegacy,
+			rerrCode:     rerrCode,
 		},
 	}
 }
 
+func newSecurePlugin(caller string, rerrCode int32, algorithm string, cipherkey string, acceptLegacy bool) tp.Plugin {
+	keyring, err := NewKeyring(cipherkey)
+	if err != nil {
+		tp.Fatalf("%s: %v", caller, err)
+	}
+	if !keyring.current().supports(algorithm) {
+		tp.Fatalf("%s: unsupported algorithm %q for the %d bytes cipherkey", caller, algorithm, len(cipherkey))
+	}
+	return NewKeyringPlugin(rerrCode, algorithm, keyring, acceptLegacy)
+}
+
+// NewRequireSecurePlugin creates a plugin that rejects the PULL and PUSH whose body is not encrypted.
+// Register it on the routes that require the encryption, together with the secure plugin.
+// Note: Without it, the packet that is not marked by SECURE_META_KEY is accepted in plaintext, even in AEAD mode.
+func NewRequireSecurePlugin(rerrCode int32) tp.Plugin {
+	return &requirePlugin{rerrCode: rerrCode}
+}
+
+type requirePlugin struct {
+	rerrCode int32
+}
+
+var (
+	_ tp.PreReadPullBodyPlugin = (*requirePlugin)(nil)
+	_ tp.PreReadPushBodyPlugin = (*requirePlugin)(nil)
+)
+
+func (r *requirePlugin) Name() string {
+	return "require-secure"
+}
+
+func (r *requirePlugin) PreReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	if goutil.BytesToString(ctx.PeekMeta(SECURE_META_KEY)) != "true" {
+		return tp.NewRerror(r.rerrCode, "require secure", "the body is not encrypted")
+	}
+	return nil
+}
+
+func (r *requirePlugin) PreReadPushBody(ctx tp.ReadCtx) *tp.Rerror {
+	return r.PreReadPullBody(ctx)
+}
+
 // EnforceSecure enforces the body of the encrypted reply packet.
 // Note: requires that the secure plugin has been registered!
 func EnforceSecure(output *socket.Packet) {
@@ -91,6 +159,8 @@ type swapKey string
 const (
 	encrypt_rawbody swapKey = ""
 	accept_encrypt  swapKey = "0"
+	legacy_encrypt  swapKey = "1"
+	seen_key        swapKey = "2"
 )
 
 type (
@@ -99,9 +169,10 @@ type (
 		*decryptPlugin
 	}
 	encryptPlugin struct {
-		version   string
-		cipherkey []byte
-		rerrCode  int32
+		keyring      *Keyring
+		algorithm    string
+		acceptLegacy bool
+		rerrCode     int32
 	}
 	decryptPlugin encryptPlugin
 )
@@ -156,14 +227,27 @@ func (e *encryptPlugin) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
 	}
 
 	// query: perform encryption operation to the query parameters.
+	key := e.keyring.current()
 	output := ctx.Output()
+	algorithm := e.algorithm
+	if _, legacy := ctx.Swap().Load(legacy_encrypt); legacy && output.Ptype() == tp.TypeReply {
+		// replies the legacy PULL in the same way, for the migration.
+		algorithm = ""
+	}
 	// if output.Ptype() != tp.TypeReply {
 	u := output.UriObject()
 	if len(u.RawQuery) > 0 {
-		ciphertext := goutil.AESEncrypt(e.cipherkey, goutil.StringToBytes(u.RawQuery))
+		aad := additionalData(output.Seq(), u.Path, output.Ptype(), CIPHERTEXT_KEY)
+		ciphertext, err := key.encrypt(algorithm, goutil.StringToBytes(u.RawQuery), aad)
+		if err != nil {
+			return tp.NewRerror(e.rerrCode, "encrypt query error", err.Error())
+		}
 		v := make(url.Values, 0)
-		v.Set(CIPHERVERSION_KEY, e.version)
+		v.Set(CIPHERVERSION_KEY, key.version)
 		v.Set(CIPHERTEXT_KEY, goutil.BytesToString(ciphertext))
+		if len(algorithm) > 0 {
+			v.Set(CIPHERALGORITHM_KEY, algorithm)
+		}
 		u.RawQuery = v.Encode()
 	}
 	// }
@@ -173,10 +257,15 @@ func (e *encryptPlugin) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
 	if err != nil {
 		return tp.NewRerror(e.rerrCode, "marshal raw body error", err.Error())
 	}
-	ciphertext := goutil.AESEncrypt(e.cipherkey, bodyBytes)
+	aad := additionalData(output.Seq(), u.Path, output.Ptype(), "body")
+	ciphertext, err := key.encrypt(algorithm, bodyBytes, aad)
+	if err != nil {
+		return tp.NewRerror(e.rerrCode, "encrypt body error", err.Error())
+	}
 	ctx.Output().SetBody(&Encrypt{
-		Cipherversion: e.version,
-		Ciphertext:    goutil.BytesToString(ciphertext),
+		Cipherversion:   key.version,
+		Ciphertext:      goutil.BytesToString(ciphertext),
+		Cipheralgorithm: algorithm,
 	})
 	return nil
 }
@@ -212,23 +301,32 @@ func (e *decryptPlugin) PreReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
 	// query: decrypt query parameters
 	version := ctx.Query().Get(CIPHERVERSION_KEY)
 	if len(version) == 0 {
+		if len(e.algorithm) > 0 && len(ctx.UriObject().RawQuery) > 0 {
+			// the AEAD mode does not accept the plaintext query of the secure packet.
+			return e.emptyVersionRerror()
+		}
 		return nil
 	}
-	if version != e.version {
-		return tp.NewRerror(
-			e.rerrCode,
-			"decrypt ciphertext error",
-			fmt.Sprintf("inconsistent encryption version, get:%q, want:%q", version, e.version),
-		)
+	key, rerr := e.lookup(version)
+	if rerr != nil {
+		return rerr
+	}
+	algorithm := ctx.Query().Get(CIPHERALGORITHM_KEY)
+	if rerr = e.checkAlgorithm(algorithm); rerr != nil {
+		return rerr
 	}
 	ciphertext := ctx.Query().Get(CIPHERTEXT_KEY)
-	queryBytes, err := goutil.AESDecrypt(e.cipherkey, goutil.StringToBytes(ciphertext))
+	aad := additionalData(ctx.Seq(), ctx.Path(), ctx.Input().Ptype(), CIPHERTEXT_KEY)
+	queryBytes, err := key.decrypt(algorithm, goutil.StringToBytes(ciphertext), aad)
 	if err != nil {
 		return tp.NewRerror(e.rerrCode, "decrypt ciphertext error", err.Error())
 	}
+	key.seen()
+	ctx.Swap().Store(seen_key, key)
 	q := ctx.Query()
 	q.Del(CIPHERVERSION_KEY)
 	q.Del(CIPHERTEXT_KEY)
+	q.Del(CIPHERALGORITHM_KEY)
 	ctx.UriObject().RawQuery = goutil.BytesToString(queryBytes)
 	last := q.Encode()
 	if len(last) > 0 {
@@ -248,22 +346,36 @@ func (e *decryptPlugin) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
 	var bodyBytes []byte
 	var err error
 
+	if len(version) == 0 && len(e.algorithm) > 0 {
+		// the AEAD mode does not accept the secure body without the ciphertext.
+		return e.emptyVersionRerror()
+	}
 	if len(version) > 0 {
-		if version != e.version {
-			return tp.NewRerror(
-				e.rerrCode,
-				"decrypt ciphertext error",
-				fmt.Sprintf("inconsistent encryption version, get:%q, want:%q", obj.GetCipherversion(), e.version),
-			)
+		key, rerr := e.lookup(version)
+		if rerr != nil {
+			return rerr
+		}
+		algorithm := obj.GetCipheralgorithm()
+		if rerr = e.checkAlgorithm(algorithm); rerr != nil {
+			return rerr
 		}
 		ciphertext := obj.GetCiphertext()
-		bodyBytes, err = goutil.AESDecrypt(e.cipherkey, goutil.StringToBytes(ciphertext))
+		aad := additionalData(ctx.Seq(), ctx.Path(), ctx.Input().Ptype(), "body")
+		bodyBytes, err = key.decrypt(algorithm, goutil.StringToBytes(ciphertext), aad)
 		if err != nil {
 			return tp.NewRerror(e.rerrCode, "decrypt ciphertext error", err.Error())
 		}
+		if algorithm != e.algorithm {
+			ctx.Swap().Store(legacy_encrypt, nil)
+		}
+		// counts the packet once, if the query is not encrypted by the same cipherkey.
+		if seenKey, ok := ctx.Swap().Load(seen_key); !ok || seenKey != key {
+			key.seen()
+		}
 	}
 
 	ctx.Swap().Delete(encrypt_rawbody)
+	ctx.Swap().Delete(seen_key)
 	ctx.Input().SetBody(rawbody)
 	err = ctx.Input().UnmarshalBody(bodyBytes)
 	if err != nil {
@@ -272,6 +384,35 @@ func (e *decryptPlugin) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
 	return nil
 }
 
+// lookup returns the cipherkey of the version in the keyring.
+func (e *decryptPlugin) lookup(version string) (*secureKey, *tp.Rerror) {
+	key, ok := e.keyring.lookup(version)
+	if !ok {
+		return nil, tp.NewRerror(
+			e.rerrCode,
+			"decrypt ciphertext error",
+			fmt.Sprintf("inconsistent encryption version, get:%q, want one of:%q", version, e.keyring.Versions()),
+		)
+	}
+	return key, nil
+}
+
+func (e *decryptPlugin) emptyVersionRerror() *tp.Rerror {
+	return tp.NewRerror(e.rerrCode, "decrypt ciphertext error", "empty encryption version")
+}
+
+// checkAlgorithm rejects the algorithm that is not configured, to prevent the downgrade.
+func (e *decryptPlugin) checkAlgorithm(algorithm string) *tp.Rerror {
+	if algorithm == e.algorithm || (len(algorithm) == 0 && e.acceptLegacy) {
+		return nil
+	}
+	return tp.NewRerror(
+		e.rerrCode,
+		"decrypt ciphertext error",
+		fmt.Sprintf("unexpected encryption algorithm, get:%q, want:%q", algorithm, e.algorithm),
+	)
+}
+
 func (e *decryptPlugin) PreReadReplyBody(ctx tp.ReadCtx) *tp.Rerror {
 	return e.PreReadPullBody(ctx)
 }
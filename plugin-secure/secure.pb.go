@@ -31,8 +31,9 @@ var _ = math.Inf
 const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
 type Encrypt struct {
-	Cipherversion string `protobuf:"bytes,1,opt,name=cipherversion,proto3" json:"cipherversion,omitempty"`
-	Ciphertext    string `protobuf:"bytes,2,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	Cipherversion   string `protobuf:"bytes,1,opt,name=cipherversion,proto3" json:"cipherversion,omitempty"`
+	Ciphertext      string `protobuf:"bytes,2,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	Cipheralgorithm string `protobuf:"bytes,3,opt,name=cipheralgorithm,proto3" json:"cipheralgorithm,omitempty"`
 }
 
 func (m *Encrypt) Reset()                    { *m = Encrypt{} }
@@ -54,6 +55,13 @@ func (m *Encrypt) GetCiphertext() string {
 	return ""
 }
 
+func (m *Encrypt) GetCipheralgorithm() string {
+	if m != nil {
+		return m.Cipheralgorithm
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Encrypt)(nil), "secure.Encrypt")
 }
@@ -84,6 +92,12 @@ func (m *Encrypt) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintSecure(dAtA, i, uint64(len(m.Ciphertext)))
 		i += copy(dAtA[i:], m.Ciphertext)
 	}
+	if len(m.Cipheralgorithm) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintSecure(dAtA, i, uint64(len(m.Cipheralgorithm)))
+		i += copy(dAtA[i:], m.Cipheralgorithm)
+	}
 	return i, nil
 }
 
@@ -125,6 +139,10 @@ func (m *Encrypt) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovSecure(uint64(l))
 	}
+	l = len(m.Cipheralgorithm)
+	if l > 0 {
+		n += 1 + l + sovSecure(uint64(l))
+	}
 	return n
 }
 
@@ -228,6 +246,35 @@ func (m *Encrypt) Unmarshal(dAtA []byte) error {
 			}
 			m.Ciphertext = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipheralgorithm", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSecure
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthSecure
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipheralgorithm = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipSecure(dAtA[iNdEx:])
@@ -357,13 +404,14 @@ var (
 func init() { proto.RegisterFile("secure.proto", fileDescriptorSecure) }
 
 var fileDescriptorSecure = []byte{
-	// 119 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0x4e, 0x4d, 0x2e,
-	0x2d, 0x4a, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x83, 0xf0, 0x94, 0xfc, 0xb9, 0xd8,
+	// 132 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe3, 0xe2, 0x29, 0x4e, 0x4d, 0x2e,
+	0x2d, 0x4a, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x83, 0xf0, 0x94, 0x2a, 0xb9, 0xd8,
 	0x5d, 0xf3, 0x92, 0x8b, 0x2a, 0x0b, 0x4a, 0x84, 0x54, 0xb8, 0x78, 0x93, 0x33, 0x0b, 0x32, 0x52,
 	0x8b, 0xca, 0x52, 0x8b, 0x8a, 0x33, 0xf3, 0xf3, 0x24, 0x18, 0x15, 0x18, 0x35, 0x38, 0x83, 0x50,
 	0x05, 0x85, 0xe4, 0xb8, 0xb8, 0x20, 0x02, 0x25, 0xa9, 0x15, 0x25, 0x12, 0x4c, 0x60, 0x25, 0x48,
-	0x22, 0x4e, 0x02, 0x27, 0x1e, 0xc9, 0x31, 0x5e, 0x78, 0x24, 0xc7, 0xf8, 0xe0, 0x91, 0x1c, 0xe3,
-	0x84, 0xc7, 0x72, 0x0c, 0x49, 0x6c, 0x60, 0x1b, 0x8d, 0x01, 0x01, 0x00, 0x00, 0xff, 0xff, 0x82,
-	0x75, 0x04, 0x35, 0x81, 0x00, 0x00, 0x00,
+	0x22, 0x42, 0x1a, 0x5c, 0xfc, 0x10, 0x5e, 0x62, 0x4e, 0x7a, 0x7e, 0x51, 0x66, 0x49, 0x46, 0xae,
+	0x04, 0x33, 0x58, 0x11, 0xba, 0xb0, 0x93, 0xc0, 0x89, 0x47, 0x72, 0x8c, 0x17, 0x80, 0xf8, 0x01,
+	0x10, 0x4f, 0x78, 0x2c, 0xc7, 0x90, 0xc4, 0x06, 0x76, 0x9b, 0x31, 0x00, 0x9f, 0x13, 0x03, 0xf4,
+	0xab, 0x00, 0x00, 0x00,
 }
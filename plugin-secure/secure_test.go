@@ -1,10 +1,12 @@
 package secure_test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
 	secure "github.com/henrylee2cn/tp-ext/plugin-secure"
 )
 
@@ -26,6 +28,10 @@ func (m *math) Add(arg *Arg) (*Result, *tp.Rerror) {
 	return &Result{C: arg.A + arg.B}, nil
 }
 
+func (m *math) Sub(arg *Arg) (*Result, *tp.Rerror) {
+	return &Result{C: arg.A - arg.B}, nil
+}
+
 func newSession(t *testing.T) tp.Session {
 	p := secure.NewSecurePlugin(100001, "cipherkey1234567")
 	srv := tp.NewPeer(tp.PeerConfig{
@@ -84,3 +90,224 @@ func TestAcceptSecurePlugin(t *testing.T) {
 	}
 	t.Logf("test accept secure: 20+4=%d", result.C)
 }
+
+func TestAEADPlugin(t *testing.T) {
+	cipherkey := "cipherkey1234567cipherkey1234567"
+	port := uint16(9091)
+	for _, algorithm := range []string{secure.AES_GCM, secure.CHACHA20_POLY1305} {
+		for _, acceptLegacy := range []bool{true, false} {
+			srv := tp.NewPeer(tp.PeerConfig{
+				ListenPort:  port,
+				PrintDetail: true,
+			})
+			srv.RoutePull(new(math), secure.NewAEADPlugin(100001, algorithm, cipherkey, acceptLegacy))
+			go srv.ListenAndServe()
+			time.Sleep(time.Second)
+
+			// the client of NewSecurePlugin can talk to the AEAD server only if it accepts the legacy, for the migration.
+			cliPlugins := []tp.Plugin{
+				secure.NewAEADPlugin(100001, algorithm, cipherkey, false),
+				secure.NewSecurePlugin(100001, cipherkey),
+			}
+			for i, cliPlugin := range cliPlugins {
+				cli := tp.NewPeer(tp.PeerConfig{
+					PrintDetail: true,
+				}, cliPlugin)
+				sess, err := cli.Dial(fmt.Sprintf(":%d", port))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result Result
+				rerr := sess.Pull(
+					"/math/add?x=1&y=2",
+					&Arg{A: 30, B: 6},
+					&result,
+					secure.WithSecureMeta(),
+				).Rerror()
+				cli.Close()
+				if i == 1 && !acceptLegacy {
+					if rerr == nil {
+						t.Fatal("expect the legacy ciphertext rejected")
+					}
+					continue
+				}
+				if rerr != nil {
+					t.Fatal(rerr)
+				}
+				if result.C != 36 {
+					t.Fatalf("expect 36, but get %d", result.C)
+				}
+				t.Logf("test %s: 30+6=%d", algorithm, result.C)
+			}
+			srv.Close()
+			port++
+		}
+	}
+}
+
+type tamperPlugin struct {
+	tamper func(*socket.Packet)
+}
+
+func (p *tamperPlugin) Name() string {
+	return "tamper"
+}
+
+// PreWritePull tampers the PULL encrypted by the secure plugin registered before it.
+func (p *tamperPlugin) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	if p.tamper != nil {
+		p.tamper(ctx.Output())
+	}
+	return nil
+}
+
+func TestAEADTamper(t *testing.T) {
+	cipherkey := "cipherkey1234567cipherkey1234567"
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort:  9096,
+		PrintDetail: true,
+	})
+	srv.RoutePull(
+		new(math),
+		secure.NewAEADPlugin(100001, secure.AES_GCM, cipherkey, false),
+		secure.NewRequireSecurePlugin(100001),
+	)
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+	defer srv.Close()
+
+	tamper := new(tamperPlugin)
+	cli := tp.NewPeer(tp.PeerConfig{
+		PrintDetail: true,
+	}, secure.NewAEADPlugin(100001, secure.AES_GCM, cipherkey, false), tamper)
+	defer cli.Close()
+	sess, rerr := cli.Dial(":9096")
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	cases := []struct {
+		name      string
+		tamper    func(*socket.Packet)
+		plaintext bool
+	}{
+		{name: "flip a byte of the ciphertext", tamper: func(p *socket.Packet) {
+			obj := p.Body().(*secure.Encrypt)
+			b := []byte(obj.Ciphertext)
+			if i := len(b) / 2; b[i] == 'A' {
+				b[i] = 'B'
+			} else {
+				b[i] = 'A'
+			}
+			obj.Ciphertext = string(b)
+		}},
+		{name: "move to another URI", tamper: func(p *socket.Packet) {
+			p.UriObject().Path = "/math/sub"
+		}},
+		{name: "strip the cipherversion", tamper: func(p *socket.Packet) {
+			obj := p.Body().(*secure.Encrypt)
+			obj.Cipherversion = ""
+			obj.Ciphertext = ""
+		}},
+		{name: "send the plaintext", plaintext: true},
+	}
+	for _, c := range cases {
+		tamper.tamper = c.tamper
+		var setting []socket.PacketSetting
+		if !c.plaintext {
+			setting = append(setting, secure.WithSecureMeta())
+		}
+		var result Result
+		rerr := sess.Pull("/math/add", &Arg{A: 40, B: 8}, &result, setting...).Rerror()
+		if rerr == nil || rerr.Code != 100001 {
+			t.Fatalf("%s: expect the error code 100001, but get %v", c.name, rerr)
+		}
+		t.Logf("test %s: %v", c.name, rerr)
+	}
+	// the untampered one is still accepted.
+	tamper.tamper = nil
+	var result Result
+	rerr = sess.Pull("/math/add", &Arg{A: 40, B: 8}, &result, secure.WithSecureMeta()).Rerror()
+	if rerr != nil || result.C != 48 {
+		t.Fatalf("expect 48, but get %d, %v", result.C, rerr)
+	}
+}
+
+func TestKeyringPlugin(t *testing.T) {
+	const cipherkey1, cipherkey2 = "cipherkey1234567", "cipherkey7654321"
+	srvRing, err := secure.NewKeyring(cipherkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliRing, _ := secure.NewKeyring(cipherkey1)
+	version1 := srvRing.Current()
+
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort:  9095,
+		PrintDetail: true,
+	})
+	srv.RoutePull(new(math), secure.NewKeyringPlugin(100001, secure.AES_GCM, srvRing, false))
+	go srv.ListenAndServe()
+	time.Sleep(time.Second)
+	defer srv.Close()
+
+	cli := tp.NewPeer(tp.PeerConfig{
+		PrintDetail: true,
+	}, secure.NewKeyringPlugin(100001, secure.AES_GCM, cliRing, false))
+	defer cli.Close()
+	sess, rerr := cli.Dial(":9095")
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	pull := func(expectOK bool) {
+		var result Result
+		rerr := sess.Pull("/math/add?x=1", &Arg{A: 1, B: 2}, &result, secure.WithSecureMeta()).Rerror()
+		if expectOK && (rerr != nil || result.C != 3) {
+			t.Fatalf("expect 3, but get %d, %v", result.C, rerr)
+		}
+		if !expectOK && rerr == nil {
+			t.Fatal("expect the decryption error")
+		}
+	}
+	pull(true)
+
+	// rotate: accept the new cipherkey on both peers, then encrypt with it.
+	srvRing.Accept(cipherkey2)
+	version2, _ := cliRing.Accept(cipherkey2)
+	cliRing.Add(cipherkey2)
+	pull(true)
+	srvRing.Add(cipherkey2)
+	pull(true)
+	if srvRing.Current() != version2 {
+		t.Fatalf("expect the current version %q, but get %q", version2, srvRing.Current())
+	}
+	seen := srvRing.Seen()
+	if len(seen) != 2 || seen[0].Version != version1 || seen[0].Packets != 1 || seen[1].Packets != 2 {
+		t.Fatalf("unexpected seen versions: %+v", seen)
+	}
+
+	// retire the old cipherkey.
+	if err = srvRing.Retire(version1); err != nil {
+		t.Fatal(err)
+	}
+	pull(true)
+	if err = srvRing.Retire(version2); err == nil {
+		t.Fatal("expect that the last cipherkey can not be retired")
+	}
+	cliRing.Retire(version2)
+	cliRing.Add(cipherkey1)
+	pull(false)
+
+	// the newest cipherkey should support the algorithm of the plugin.
+	const cipherkey3 = "cipherkey1234567cipherkey1234567"
+	ring, _ := secure.NewKeyring(cipherkey3)
+	secure.NewKeyringPlugin(100001, secure.CHACHA20_POLY1305, ring, false)
+	if _, err = ring.Add(cipherkey1); err == nil {
+		t.Fatal("expect that the 16 bytes cipherkey can not encrypt ChaCha20-Poly1305")
+	}
+	if _, err = ring.Accept(cipherkey1); err != nil {
+		t.Fatal(err)
+	}
+	if err = ring.Retire(ring.Current()); err == nil {
+		t.Fatal("expect that the newest cipherkey can not be retired in favor of the 16 bytes one")
+	}
+}